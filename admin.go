@@ -0,0 +1,115 @@
+package main;
+
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/http"
+import "os"
+import "path/filepath"
+
+// Lets the admin list, create, rename, disable, enable, delete and unlock users and reset
+// their passwords. Expects a form POST with admin_password, action, name and, depending on the
+// action, new_name or password.
+func (u *Users) http_manage_users(w http.ResponseWriter, r *http.Request){
+    if r.Method=="GET"{
+        w.Header().Set("Content-Type", "text/html")
+        http.ServeFile(w, r, filepath.Join(u.config.Frontend_dir, "manage_users.html"))
+        return
+    }
+
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be GET or POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    action:=r.FormValue("action")
+    name:=r.FormValue("name")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    if action=="list"{
+        type Listed_user struct{
+            Name string `json:"name"`
+            Disabled bool `json:"disabled"`
+        }
+
+        listed_users:=[]Listed_user{}
+        for _,user:=range u.get_user_list(){
+            listed_users=append(listed_users, Listed_user{user.Name, user.Disabled})
+        }
+
+        u.audit(r, "admin", "list_users", "", "", "")
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(listed_users)
+        return
+    }
+
+    // The admin account itself can only have its password changed and be unlocked
+    if name=="admin" && action!="reset_password" && action!="unlock"{
+        http.Error(w, "The admin user cannot be changed this way", http.StatusBadRequest)
+        return
+    }
+
+    // Keys cannot change passwords, a leaked key must not be enough to take over the admin
+    if action=="reset_password" && api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    actor:=Actor{"admin", r}
+    var message string
+    switch action{
+    case "create":
+        err=u.add_user(actor, name, r.FormValue("password"))
+        message=fmt.Sprintf("User created: %s", name)
+    case "rename":
+        err=u.rename_user(actor, name, r.FormValue("new_name"))
+        message=fmt.Sprintf("User renamed: %s -> %s", name, r.FormValue("new_name"))
+    case "disable":
+        err=u.set_user_disabled(actor, name, true)
+        message=fmt.Sprintf("User disabled: %s", name)
+    case "enable":
+        err=u.set_user_disabled(actor, name, false)
+        message=fmt.Sprintf("User enabled: %s", name)
+    case "delete":
+        err=u.remove_user(actor, name)
+        message=fmt.Sprintf("User deleted: %s", name)
+    case "reset_password":
+        err=u.reset_password(actor, name, r.FormValue("password"))
+        message=fmt.Sprintf("Password reset: %s", name)
+    case "unlock":
+        // Addresses that are locked out can be unlocked the same way
+        if !u.login_guard.unlock(name){
+            err=errors.New("Neither a user nor an address with that name has failed logins")
+        } else{
+            u.audit(r, "admin", "unlock", name, "", "")
+        }
+        message=fmt.Sprintf("Unlocked: %s", name)
+    default:
+        http.Error(w, "Unknown action", http.StatusBadRequest)
+        return
+    }
+
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Save changes to file
+    err=u.to_file(u.config.Data_file)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+    }
+    fmt.Println(message)
+
+    // The message contains user supplied names, so it is not sent as html
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Write([]byte(message))
+}
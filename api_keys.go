@@ -0,0 +1,354 @@
+package main;
+
+import "context"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// What an api key may be used for
+type Api_key_scope string
+
+const(
+    // The day view (/get_entries and /events), which is public anyway (the key gives the
+    // script its own rate limit and shows when it was last used), and /see_all without
+    // the names of the users
+    scope_read Api_key_scope="read"
+    // Adding and removing the entries of one user (and what the read scope allows)
+    scope_book Api_key_scope="book"
+    // Everything the admin's password allows, except seeing and changing passwords (the
+    // raw exports, reset codes, password resets, updating users by provisioning and
+    // importing data) and managing keys
+    scope_admin Api_key_scope="admin"
+)
+
+// Every key starts like this, so leaked keys are easy to search for
+const api_key_prefix="kathrin_"
+
+// Last_used is only saved this often, not on every request
+const api_key_save_interval=time.Minute
+
+var error_api_key_scope=errors.New("The api key does not allow this")
+
+type Api_key struct{
+    Id string `json:"id"`
+    Label string `json:"label"`
+    Scope Api_key_scope `json:"scope"`
+    // The user a book key acts for
+    User string `json:"user,omitempty"`
+    // Hash of the secret part, the key itself is only shown when it is issued
+    Hash string `json:"hash,omitempty"`
+    Created time.Time `json:"created"`
+    Last_used time.Time `json:"last_used,omitempty"`
+    Rate_per_minute int `json:"rate_per_minute"`
+}
+
+// Whether the key may act as the named user
+func (k *Api_key) allows(name string) bool{
+    switch k.Scope{
+    case scope_admin:
+        return name=="admin"
+    case scope_book:
+        return name==k.User && name!=""
+    }
+    return false
+}
+
+// The api keys the admin issued, kept in a file
+type Api_keys struct{
+    users *Users
+    filename string
+    default_rate_per_minute int
+    lock *sync.Mutex
+    keys []Api_key
+    buckets map[string]*Token_bucket
+    last_saved time.Time
+    // Whether a Last_used was not saved yet
+    unsaved bool
+}
+
+// Loads the keys from a file, a missing file means there are none yet
+func new_api_keys(users *Users, filename string, default_rate_per_minute int) (*Api_keys, error){
+    keys:=[]Api_key{}
+    content, err:=ioutil.ReadFile(filename)
+    if err==nil{
+        err=json.Unmarshal(content, &keys)
+        if err!=nil{
+            return nil, err
+        }
+    } else if !os.IsNotExist(err){
+        return nil, err
+    }
+
+    return &Api_keys{users, filename, default_rate_per_minute, &sync.Mutex{}, keys, make(map[string]*Token_bucket), time.Now(), false}, nil
+}
+
+func hash_api_key_secret(secret string) string{
+    hash:=sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(hash[:])
+}
+
+// Must be called with the lock held
+func (a *Api_keys) save(now time.Time) error{
+    b, err:=json.MarshalIndent(a.keys, "", "    ")
+    if err!=nil{
+        return err
+    }
+    a.last_saved=now
+    a.unsaved=false
+    return ioutil.WriteFile(a.filename, b, 0600)
+}
+
+// Saves the times keys were last used, if there are new ones
+func (a *Api_keys) flush() error{
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    if !a.unsaved{
+        return nil
+    }
+    return a.save(time.Now())
+}
+
+// Creates a key and returns it, it cannot be looked up again later
+func (a *Api_keys) issue(label string, scope Api_key_scope, user string, rate_per_minute int, now time.Time) (Api_key, string, error){
+    switch scope{
+    case scope_read, scope_admin:
+        user=""
+    case scope_book:
+        _, err:=a.users.get_users_entries(user)
+        if err!=nil{
+            return Api_key{}, "", err
+        }
+    default:
+        return Api_key{}, "", errors.New("Scope must be read, book or admin")
+    }
+    if rate_per_minute==0{
+        rate_per_minute=a.default_rate_per_minute
+    }
+    if rate_per_minute<1{
+        return Api_key{}, "", errors.New("The rate must be at least one request per minute")
+    }
+
+    random:=make([]byte, 24)
+    _, err:=rand.Read(random)
+    if err!=nil{
+        return Api_key{}, "", err
+    }
+    id:=hex.EncodeToString(random[:4])
+    secret:=hex.EncodeToString(random[4:])
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    key:=Api_key{id, label, scope, user, hash_api_key_secret(secret), now, time.Time{}, rate_per_minute}
+    a.keys=append(a.keys, key)
+    err=a.save(now)
+    if err!=nil{
+        a.keys=a.keys[:len(a.keys)-1]
+        return Api_key{}, "", err
+    }
+    return key, api_key_prefix+id+"_"+secret, nil
+}
+
+// Returns every key without its hash
+func (a *Api_keys) list() []Api_key{
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    keys:=[]Api_key{}
+    for _,key:=range a.keys{
+        key.Hash=""
+        keys=append(keys, key)
+    }
+    return keys
+}
+
+func (a *Api_keys) revoke(id string, now time.Time) error{
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    for i,key:=range a.keys{
+        if key.Id==id{
+            a.keys=append(a.keys[:i], a.keys[i+1:]...)
+            delete(a.buckets, id)
+            return a.save(now)
+        }
+    }
+    return errors.New("There is no api key with that id")
+}
+
+// Finds the key, takes a token from its bucket and notes the use. Returns how long to
+// wait if the key is over its rate.
+func (a *Api_keys) use(value string, now time.Time) (Api_key, time.Duration, error){
+    unknown:=errors.New("Unknown api key")
+    parts:=strings.Split(strings.TrimPrefix(value, api_key_prefix), "_")
+    if !strings.HasPrefix(value, api_key_prefix) || len(parts)!=2{
+        return Api_key{}, 0, unknown
+    }
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    for i:=range a.keys{
+        key:=&a.keys[i]
+        if key.Id!=parts[0]{
+            continue
+        }
+        if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash_api_key_secret(parts[1])))!=1{
+            return Api_key{}, 0, unknown
+        }
+
+        bucket:=a.buckets[key.Id]
+        if bucket==nil{
+            bucket=new_token_bucket(float64(key.Rate_per_minute)/60, float64(key.Rate_per_minute), now)
+            a.buckets[key.Id]=bucket
+        }
+        ok, wait:=bucket.take(now)
+        if !ok{
+            return *key, wait, nil
+        }
+
+        key.Last_used=now
+        a.unsaved=true
+        if now.Sub(a.last_saved)>=api_key_save_interval{
+            err:=a.save(now)
+            if err!=nil{
+                fmt.Fprintln(os.Stderr, "Could not save api keys:", err)
+            }
+        }
+        return *key, 0, nil
+    }
+    return Api_key{}, 0, unknown
+}
+
+type api_key_context_key struct{}
+
+// The key the request was made with, if any
+func api_key_from_request(r *http.Request) *Api_key{
+    key, _:=r.Context().Value(api_key_context_key{}).(*Api_key)
+    return key
+}
+
+// Keys are sent as "Authorization: Bearer <key>" or "X-Api-Key: <key>"
+func api_key_header(r *http.Request) string{
+    if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer "){
+        return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+    }
+    return strings.TrimSpace(r.Header.Get("X-Api-Key"))
+}
+
+// Checks the key of requests that come with one and makes it available to the handlers,
+// which accept it instead of a password (see authenticate)
+func (a *Api_keys) wrap(handler http.Handler) http.Handler{
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        value:=api_key_header(r)
+        if value==""{
+            handler.ServeHTTP(w, r)
+            return
+        }
+
+        address:=remote_host(r)
+        wait:=a.users.login_guard.address_wait(address)
+        if wait>0{
+            http_login_error(w, &Login_blocked_error{wait, false})
+            return
+        }
+
+        key, wait, err:=a.use(value, time.Now())
+        if err!=nil{
+            a.users.metrics.failed_login("unknown_api_key")
+            // Keys are guessed like passwords
+            if a.users.login_guard.address_failed(address){
+                fmt.Println("Address locked out:", address)
+                a.users.audit(r, "", "lockout_address", address, "", a.users.login_guard.lockout.String())
+            }
+            http.Error(w, err.Error(), http.StatusUnauthorized)
+            return
+        }
+        if wait>0{
+            w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+            http.Error(w, "Too many requests with this api key", http.StatusTooManyRequests)
+            return
+        }
+
+        handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), api_key_context_key{}, &key)))
+    })
+}
+
+// Lets the admin issue, list and revoke api keys. Expects a form POST with admin_password,
+// action (issue, list or revoke) and, depending on the action, label, scope, user and
+// rate_per_minute or id.
+func (a *Api_keys) http_api_keys(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    action:=r.FormValue("action")
+    err:=a.users.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // Keys cannot be used to make more keys
+    if api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    switch action{
+    case "list":
+        a.users.audit(r, "admin", "list_api_keys", "", "", "")
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(a.list())
+    case "issue":
+        rate_per_minute:=0
+        if r.FormValue("rate_per_minute")!=""{
+            rate_per_minute, err=strconv.Atoi(r.FormValue("rate_per_minute"))
+            if err!=nil{
+                http.Error(w, "rate_per_minute must be a number", http.StatusBadRequest)
+                return
+            }
+        }
+        key, value, err:=a.issue(r.FormValue("label"), Api_key_scope(r.FormValue("scope")), r.FormValue("user"), rate_per_minute, time.Now())
+        if err!=nil{
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        fmt.Println("Api key issued:", key.Id, key.Scope, key.User)
+        a.users.audit(r, "admin", "issue_api_key", key.Id, "", fmt.Sprintf("%s %s", key.Scope, key.User))
+
+        // The message contains user supplied names, so it is not sent as html
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Header().Set("Cache-Control", "no-store")
+        w.Write([]byte(fmt.Sprintf("Api key %s (%s): %s\nIt is only shown this once.", key.Id, key.Scope, value)))
+    case "revoke":
+        err=a.revoke(r.FormValue("id"), time.Now())
+        if err!=nil{
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        fmt.Println("Api key revoked:", r.FormValue("id"))
+        a.users.audit(r, "admin", "revoke_api_key", r.FormValue("id"), "", "")
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Write([]byte("Api key revoked"))
+    default:
+        http.Error(w, "Unknown action", http.StatusBadRequest)
+    }
+}
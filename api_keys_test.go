@@ -0,0 +1,181 @@
+package main;
+
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+func TestApi_keys(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+
+    keys, err:=new_api_keys(&users, "DELETEME.json", 60)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    now:=time.Now()
+    if _,_,err:=keys.issue("", scope_book, "nobody", 0, now); err==nil{
+        t.Error()
+    }
+    if _,_,err:=keys.issue("", "write", "", 0, now); err==nil{
+        t.Error()
+    }
+
+    key, value, err:=keys.issue("laundry display", scope_read, "a", 2, now)
+    if err!=nil || key.User!="" || key.Rate_per_minute!=2 || !strings.HasPrefix(value, api_key_prefix+key.Id+"_"){
+        t.Error(key, value, err)
+    }
+
+    // Keys are kept in the file and are only hashes there
+    keys, err=new_api_keys(&users, "DELETEME.json", 60)
+    if err!=nil || len(keys.keys)!=1 || strings.Contains(value, keys.keys[0].Hash){
+        t.Error()
+    }
+    if len(keys.list())!=1 || keys.list()[0].Hash!=""{
+        t.Error()
+    }
+
+    if _,_,err:=keys.use(value+"0", now); err==nil{
+        t.Error()
+    }
+    if _,_,err:=keys.use("kathrin_nothing", now); err==nil{
+        t.Error()
+    }
+    used, wait, err:=keys.use(value, now)
+    if err!=nil || wait!=0 || used.Id!=key.Id || !keys.list()[0].Last_used.Equal(now){
+        t.Error(err)
+    }
+    keys.use(value, now)
+    // Over its rate
+    _, wait, err=keys.use(value, now)
+    if err!=nil || wait!=30*time.Second{
+        t.Error(wait, err)
+    }
+
+    if keys.revoke("nothing", now)==nil{
+        t.Error()
+    }
+    if keys.revoke(key.Id, now)!=nil{
+        t.Error()
+    }
+    if _,_,err:=keys.use(value, now.Add(time.Minute)); err==nil{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestApi_keysWrap(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_user(Actor{}, "b", "password")
+    users.add_user(Actor{}, "admin", "password")
+    keys, _:=new_api_keys(&users, "DELETEME.json", 60)
+    _, read_key, _:=keys.issue("", scope_read, "", 0, time.Now())
+    _, book_key, _:=keys.issue("", scope_book, "a", 0, time.Now())
+    _, admin_key, _:=keys.issue("", scope_admin, "", 0, time.Now())
+
+    // Answers with whether the key lets the request act as the user
+    handler:=keys.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        err:=users.authenticate(r, r.URL.Query().Get("name"), "")
+        if err!=nil{
+            http_login_error(w, err)
+        }
+    }))
+    get:=func(key, name string) int{
+        r:=httptest.NewRequest("GET", "/?name="+name, nil)
+        if key!=""{
+            r.Header.Set("Authorization", "Bearer "+key)
+        }
+        w:=httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        return w.Code
+    }
+
+    if get("", "a")!=http.StatusUnauthorized{
+        t.Error()
+    }
+    if get("kathrin_0_0", "a")!=http.StatusUnauthorized{
+        t.Error()
+    }
+    if get(read_key, "a")!=http.StatusForbidden{
+        t.Error()
+    }
+    if get(book_key, "a")!=http.StatusOK || get(book_key, "b")!=http.StatusForbidden || get(book_key, "admin")!=http.StatusForbidden{
+        t.Error()
+    }
+    if get(admin_key, "admin")!=http.StatusOK || get(admin_key, "a")!=http.StatusForbidden{
+        t.Error()
+    }
+
+    // Disabled users cannot be booked for
+    users.set_user_disabled(Actor{}, "a", true)
+    if get(book_key, "a")!=http.StatusUnauthorized{
+        t.Error()
+    }
+
+    err:=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestApi_keysAdmin_passwords(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "admin", "password")
+    keys, _:=new_api_keys(&users, "DELETEME.json", 60)
+    _, admin_key, _:=keys.issue("", scope_admin, "", 0, time.Now())
+
+    post:=func(handler http.HandlerFunc, form url.Values) int{
+        r:=httptest.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        r.Header.Set("Authorization", "Bearer "+admin_key)
+        w:=httptest.NewRecorder()
+        keys.wrap(handler).ServeHTTP(w, r)
+        return w.Code
+    }
+
+    if post(users.http_manage_users, url.Values{"action": {"list"}})!=http.StatusOK{
+        t.Error()
+    }
+    if post(users.http_manage_users, url.Values{"action": {"reset_password"}, "name": {"admin"}, "password": {"taken over"}})!=http.StatusForbidden{
+        t.Error()
+    }
+    data:=`{"version": 1, "users": [{"name": "admin", "password": "taken over"}]}`
+    if post(users.http_import_data, url.Values{"format": {"json"}, "data": {data}})!=http.StatusForbidden{
+        t.Error()
+    }
+    if password, _:=users.get_users_password("admin"); password!="password"{
+        t.Error()
+    }
+
+    // Nor see them or hand out ways to set them
+    if post(users.http_export_raw, url.Values{"confirm": {raw_export_confirmation}})!=http.StatusForbidden{
+        t.Error()
+    }
+    if post(users.http_export_data, url.Values{"confirm": {raw_export_confirmation}})!=http.StatusForbidden{
+        t.Error()
+    }
+    users.add_user(Actor{}, "a", "password")
+    codes, _:=new_reset_codes(&users, "DELETEME.codes.json", time.Hour)
+    if post(codes.http_issue_reset_code, url.Values{"name": {"a"}})!=http.StatusForbidden || len(codes.codes)!=0{
+        t.Error()
+    }
+    if post(users.http_provision_users, url.Values{"format": {"csv"}, "data": {"a"}, "update_existing": {"1"}})!=http.StatusForbidden{
+        t.Error()
+    }
+    if password, _:=users.get_users_password("a"); password!="password"{
+        t.Error()
+    }
+
+    err:=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
@@ -0,0 +1,290 @@
+package main;
+
+import "bufio"
+import "encoding/csv"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// A booking that was taken out of the data file
+type Archived_booking struct{
+    Name string `json:"name"`
+    Entry Entry `json:"entry"`
+    Archived time.Time `json:"archived"`
+}
+
+// Append-only store of old bookings: one file per month of the entries (like 2017-05.jsonl)
+// with one json encoded booking per line
+type Archive struct{
+    dir string
+    lock *sync.Mutex
+}
+
+func new_archive(dir string) *Archive{
+    return &Archive{dir, &sync.Mutex{}}
+}
+
+// Name of the file the bookings of an entry's month are kept in
+func (a *Archive) month_file(entry Entry) string{
+    return filepath.Join(a.dir, fmt.Sprintf("%04d-%02d.jsonl", entry.Year, entry.Month))
+}
+
+// Appends the bookings to the files of their months. Bookings that are archived already
+// are skipped, so archiving again after a failed save (or a failed append to another
+// month's file) does not duplicate them.
+func (a *Archive) append(bookings []Booking, archived time.Time) error{
+    by_file:=make(map[string][]Booking)
+    files:=[]string{}
+    for _,booking:=range bookings{
+        file:=a.month_file(booking.Entry)
+        if _,ok:=by_file[file];!ok{
+            files=append(files, file)
+        }
+        by_file[file]=append(by_file[file], booking)
+    }
+    if len(files)==0{
+        return nil
+    }
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    err:=os.MkdirAll(a.dir, 0700)
+    if err!=nil{
+        return err
+    }
+    for _,file:=range files{
+        archived_already:=make(map[Booking]bool)
+        err=a.read_file(file, func(booking Archived_booking){
+            archived_already[Booking{booking.Name, booking.Entry}]=true
+        })
+        if err!=nil && !os.IsNotExist(err){
+            return err
+        }
+
+        lines:=[]byte{}
+        for _,booking:=range by_file[file]{
+            if archived_already[booking]{
+                continue
+            }
+            archived_already[booking]=true
+            b, err:=json.Marshal(Archived_booking{booking.Name, booking.Entry, archived})
+            if err!=nil{
+                return err
+            }
+            lines=append(append(lines, b...), '\n')
+        }
+        if len(lines)==0{
+            continue
+        }
+
+        f, err:=os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+        if err!=nil{
+            return err
+        }
+
+        _, err=f.Write(lines)
+        if err==nil{
+            err=f.Sync()
+        }
+        if err!=nil{
+            f.Close()
+            return err
+        }
+        err=f.Close()
+        if err!=nil{
+            return err
+        }
+    }
+    return nil
+}
+
+// Which archived bookings a query returns. Empty fields match everything.
+type Archive_filter struct{
+    Name string
+    // Days (entries with slot 0), both inclusive
+    From Entry
+    Until Entry
+}
+
+func (f *Archive_filter) matches(booking Archived_booking) bool{
+    if f.Name!="" && booking.Name!=f.Name{
+        return false
+    }
+    return entry_in_range(booking.Entry, f.From, f.Until)
+}
+
+// Returns the archived bookings that match the filter in chronological order. Only the
+// files of the months in the filter's range are read.
+func (a *Archive) query(filter Archive_filter) ([]Archived_booking, error){
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    bookings:=[]Archived_booking{}
+    files, err:=ioutil.ReadDir(a.dir)
+    if os.IsNotExist(err){
+        return bookings, nil
+    }
+    if err!=nil{
+        return nil, err
+    }
+
+    for _,file:=range files{
+        if file.IsDir() || !strings.HasSuffix(file.Name(), ".jsonl"){
+            continue
+        }
+        month, err:=time.Parse("2006-01", strings.TrimSuffix(file.Name(), ".jsonl"))
+        if err!=nil{
+            continue
+        }
+        first_day:=Entry{month.Year(), int(month.Month()), 1, 0}
+        last_day:=Entry{month.Year(), int(month.Month()), 31, 0}
+        if (filter.From!=(Entry{}) && last_day.Before(filter.From)) || (filter.Until!=(Entry{}) && filter.Until.Before(first_day)){
+            continue
+        }
+
+        err=a.read_file(filepath.Join(a.dir, file.Name()), func(booking Archived_booking){
+            if filter.matches(booking){
+                bookings=append(bookings, booking)
+            }
+        })
+        if err!=nil{
+            return nil, err
+        }
+    }
+
+    sort.SliceStable(bookings, func(i, j int) bool{
+        return bookings[i].Entry.Before(bookings[j].Entry)
+    })
+    return bookings, nil
+}
+
+func (a *Archive) read_file(filename string, found func(Archived_booking)) error{
+    f, err:=os.Open(filename)
+    if err!=nil{
+        return err
+    }
+    defer f.Close()
+
+    scanner:=bufio.NewScanner(f)
+    for scanner.Scan(){
+        var booking Archived_booking
+        err=json.Unmarshal(scanner.Bytes(), &booking)
+        if err!=nil{
+            return fmt.Errorf("%s: %s", filename, err)
+        }
+        found(booking)
+    }
+    return scanner.Err()
+}
+
+// Writes the archived bookings as csv (name, year, month, day, slot, archived) or json
+func write_archived_bookings(writer io.Writer, bookings []Archived_booking, format string) error{
+    if format=="json"{
+        b, err:=json.MarshalIndent(bookings, "", "    ")
+        if err!=nil{
+            return err
+        }
+        _, err=writer.Write(append(b, '\n'))
+        return err
+    }
+
+    csv_writer:=csv.NewWriter(writer)
+    csv_writer.Write([]string{"name", "year", "month", "day", "slot", "archived"})
+    for _,booking:=range bookings{
+        entry:=booking.Entry
+        csv_writer.Write([]string{booking.Name, strconv.Itoa(entry.Year), strconv.Itoa(entry.Month), strconv.Itoa(entry.Day), strconv.Itoa(entry.Slot), booking.Archived.Format(time.RFC3339)})
+    }
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+// Moves the entries of days before the given one into the archive. If they cannot be
+// archived, nothing is removed.
+func (u *Users) archive_entries_before(actor Actor, first_day_kept Entry, archive *Archive) ([]Booking, error){
+    return u.remove_entries_before_if(actor, "archive_old_entries", first_day_kept, func(removed []Booking) error{
+        return archive.append(removed, time.Now())
+    })
+}
+
+// Archives the entries older than the configured retention period and saves the data.
+// Meant to be run by the scheduler.
+func (u *Users) run_retention() error{
+    first_day_kept, _:=day_in_the_future(-u.config.Retention_days)
+    removed, err:=u.archive_entries_before(Actor{"scheduler", nil}, first_day_kept, u.archive)
+    if err!=nil{
+        return err
+    }
+    if len(removed)==0{
+        return nil
+    }
+
+    err=u.to_file(u.config.Data_file)
+    if err!=nil{
+        return err
+    }
+    fmt.Println(len(removed), "old entries archived")
+    return nil
+}
+
+// Lets the admin look through the archive. Expects a form POST with admin_password and
+// optionally user, from, until (dates like 2017-05-03) and format (json or csv).
+func (u *Users) http_archive(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    format:=r.FormValue("format")
+    if format==""{
+        format="json"
+    }
+    if format!="json" && format!="csv"{
+        http.Error(w, "format must be json or csv", http.StatusBadRequest)
+        return
+    }
+
+    filter:=Archive_filter{Name: r.FormValue("user")}
+    filter.From, err=parse_day(r.FormValue("from"))
+    if err==nil{
+        filter.Until, err=parse_day(r.FormValue("until"))
+    }
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    bookings, err:=u.archive.query(filter)
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    u.audit(r, "admin", "query_archive", filter.Name, "", "")
+
+    if format=="csv"{
+        w.Header().Set("Content-Type", "text/csv")
+        w.Header().Set("Content-Disposition", "attachment; filename=\"archive.csv\"")
+    } else{
+        w.Header().Set("Content-Type", "application/json")
+    }
+    write_archived_bookings(w, bookings, format)
+}
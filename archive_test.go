@@ -0,0 +1,145 @@
+package main;
+
+import "bufio"
+import "bytes"
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "strings"
+import "testing"
+import "time"
+
+func read_archive_file(filename string) []Archived_booking{
+    bookings:=[]Archived_booking{}
+    f, err:=os.Open(filename)
+    if err!=nil{
+        return bookings
+    }
+    defer f.Close()
+
+    scanner:=bufio.NewScanner(f)
+    for scanner.Scan(){
+        var booking Archived_booking
+        json.Unmarshal(scanner.Bytes(), &booking)
+        bookings=append(bookings, booking)
+    }
+    return bookings
+}
+
+func TestArchiveAppend(t *testing.T){
+    archive:=new_archive("DELETEME.archive")
+    now:=time.Now()
+    err:=archive.append([]Booking{{"a", Entry{2017,5,3,4}}, {"b", Entry{2017,6,1,0}}, {"b", Entry{2017,5,30,1}}}, now)
+    if err!=nil{
+        t.Error(err)
+    }
+    err=archive.append([]Booking{{"c", Entry{2017,5,4,4}}}, now)
+    if err!=nil{
+        t.Error(err)
+    }
+
+    may:=read_archive_file(filepath.Join("DELETEME.archive", "2017-05.jsonl"))
+    if len(may)!=3 || may[0].Name!="a" || may[1].Entry!=(Entry{2017,5,30,1}) || may[2].Name!="c" || !may[2].Archived.Equal(now){
+        t.Error(may)
+    }
+    june:=read_archive_file(filepath.Join("DELETEME.archive", "2017-06.jsonl"))
+    if len(june)!=1 || june[0].Name!="b"{
+        t.Error(june)
+    }
+
+    // Archiving again (after a failed save) does not duplicate anything
+    err=archive.append([]Booking{{"a", Entry{2017,5,3,4}}, {"a", Entry{2017,6,2,0}}, {"a", Entry{2017,6,2,0}}}, now)
+    if err!=nil{
+        t.Error(err)
+    }
+    may=read_archive_file(filepath.Join("DELETEME.archive", "2017-05.jsonl"))
+    june=read_archive_file(filepath.Join("DELETEME.archive", "2017-06.jsonl"))
+    if len(may)!=3 || len(june)!=2 || june[1].Entry!=(Entry{2017,6,2,0}){
+        t.Error(may, june)
+    }
+
+    err=os.RemoveAll("DELETEME.archive")
+    if err!=nil{
+        panic("Could not remove temporary directory")
+    }
+}
+
+func TestUsersArchive_entries_before(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_entry(Actor{}, "a", Entry{2017,5,3,4})
+    users.add_entry(Actor{}, "a", Entry{2017,5,4,4})
+
+    removed, err:=users.archive_entries_before(Actor{}, Entry{2017,5,4,10}, new_archive("DELETEME.archive"))
+    if err!=nil || len(removed)!=1 || removed[0].Entry!=(Entry{2017,5,3,4}){
+        t.Error(removed, err)
+    }
+    if len(users.get_bookings())!=1 || len(read_archive_file(filepath.Join("DELETEME.archive", "2017-05.jsonl")))!=1{
+        t.Error()
+    }
+
+    // If the archive cannot be written, nothing is removed
+    err=ioutil.WriteFile("DELETEME.file", []byte{}, 0644)
+    if err!=nil{
+        panic("Could not create temporary file")
+    }
+    revision:=users.get_revision()
+    removed, err=users.archive_entries_before(Actor{}, Entry{2017,5,5,0}, new_archive("DELETEME.file"))
+    if err==nil || len(removed)!=0 || len(users.get_bookings())!=1 || users.get_revision()!=revision{
+        t.Error()
+    }
+
+    err=os.RemoveAll("DELETEME.archive")
+    if err!=nil{
+        panic("Could not remove temporary directory")
+    }
+    err=os.Remove("DELETEME.file")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestArchiveQuery(t *testing.T){
+    archive:=new_archive("DELETEME.archive")
+    bookings, err:=archive.query(Archive_filter{})
+    if err!=nil || len(bookings)!=0{
+        t.Error()
+    }
+
+    archive.append([]Booking{{"b", Entry{2017,6,1,0}}, {"a", Entry{2017,5,30,1}}, {"a", Entry{2017,5,3,4}}, {"a", Entry{2018,1,1,0}}}, time.Now())
+
+    bookings, err=archive.query(Archive_filter{})
+    if err!=nil || len(bookings)!=4 || bookings[0].Entry!=(Entry{2017,5,3,4}) || bookings[3].Entry!=(Entry{2018,1,1,0}){
+        t.Error(bookings, err)
+    }
+    bookings, _=archive.query(Archive_filter{Name: "a"})
+    if len(bookings)!=3{
+        t.Error(bookings)
+    }
+    bookings, _=archive.query(Archive_filter{From: Entry{2017,5,30,0}, Until: Entry{2017,6,1,0}})
+    if len(bookings)!=2 || bookings[0].Name!="a" || bookings[1].Name!="b"{
+        t.Error(bookings)
+    }
+    bookings, _=archive.query(Archive_filter{Name: "b", Until: Entry{2017,5,31,0}})
+    if len(bookings)!=0{
+        t.Error(bookings)
+    }
+
+    buffer:=bytes.Buffer{}
+    err=write_archived_bookings(&buffer, bookings[:0], "csv")
+    if err!=nil || buffer.String()!="name,year,month,day,slot,archived\n"{
+        t.Error(buffer.String())
+    }
+    buffer.Reset()
+    bookings, _=archive.query(Archive_filter{Name: "b"})
+    write_archived_bookings(&buffer, bookings, "csv")
+    if !strings.HasPrefix(strings.Split(buffer.String(), "\n")[1], "b,2017,6,1,0,"){
+        t.Error(buffer.String())
+    }
+
+    err=os.RemoveAll("DELETEME.archive")
+    if err!=nil{
+        panic("Could not remove temporary directory")
+    }
+}
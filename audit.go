@@ -0,0 +1,199 @@
+package main;
+
+import "bufio"
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// Records who changed what and when
+type Audit_record struct{
+    Time time.Time `json:"time"`
+    Actor string `json:"actor"`
+    Action string `json:"action"`
+    Target string `json:"target,omitempty"`
+    Before string `json:"before,omitempty"`
+    After string `json:"after,omitempty"`
+    Remote_address string `json:"remote_address,omitempty"`
+}
+
+// Which records a query returns. Empty fields (and zero times) match everything.
+type Audit_filter struct{
+    // Matches the actor or the target
+    User string
+    Action string
+    From time.Time
+    // Exclusive
+    Until time.Time
+}
+
+func (f *Audit_filter) matches(record Audit_record) bool{
+    if f.User!="" && record.Actor!=f.User && record.Target!=f.User{
+        return false
+    }
+    if f.Action!="" && record.Action!=f.Action{
+        return false
+    }
+    if !f.From.IsZero() && record.Time.Before(f.From){
+        return false
+    }
+    if !f.Until.IsZero() && !record.Time.Before(f.Until){
+        return false
+    }
+    return true
+}
+
+// An append-only file with one json encoded record per line
+type Audit_log struct{
+    filename string
+    lock *sync.Mutex
+}
+
+func new_audit_log(filename string) *Audit_log{
+    return &Audit_log{filename, &sync.Mutex{}}
+}
+
+func (a *Audit_log) append(record Audit_record) error{
+    b, err:=json.Marshal(record)
+    if err!=nil{
+        return err
+    }
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    f, err:=os.OpenFile(a.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err!=nil{
+        return err
+    }
+
+    _, err=f.Write(append(b, '\n'))
+    if err!=nil{
+        f.Close()
+        return err
+    }
+    err=f.Sync()
+    if err!=nil{
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// Returns the records that match the filter, oldest first
+func (a *Audit_log) query(filter Audit_filter) ([]Audit_record, error){
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    records:=[]Audit_record{}
+    f, err:=os.Open(a.filename)
+    if os.IsNotExist(err){
+        return records, nil
+    }
+    if err!=nil{
+        return nil, err
+    }
+    defer f.Close()
+
+    scanner:=bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+    for scanner.Scan(){
+        var record Audit_record
+        err=json.Unmarshal(scanner.Bytes(), &record)
+        if err!=nil{
+            return nil, err
+        }
+        if filter.matches(record){
+            records=append(records, record)
+        }
+    }
+
+    return records, scanner.Err()
+}
+
+// Writes a record to the users' audit log (if there is one). The request may be nil for
+// changes that do not come over the network. Errors are only printed: a change that
+// already happened cannot be undone because it could not be logged.
+func (u *Users) audit(r *http.Request, actor, action, target, before, after string){
+    if u.audit_log==nil{
+        return
+    }
+
+    record:=Audit_record{time.Now(), actor, action, target, before, after, ""}
+    if r!=nil{
+        record.Remote_address=r.RemoteAddr
+    }
+
+    err:=u.audit_log.append(record)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Could not write to audit log:", err)
+    }
+}
+
+// Who makes a change to the users. The request is nil for changes that do not come over
+// the network.
+type Actor struct{
+    Name string
+    Request *http.Request
+}
+
+// Audits a change once it succeeded. The methods of Users defer it before they take the
+// lock, so the log is written after the lock is released.
+func (u *Users) audit_change(err *error, actor Actor, action, target, before, after string){
+    if *err==nil{
+        u.audit(actor.Request, actor.Name, action, target, before, after)
+    }
+}
+
+// Lets the admin look through the audit log. Expects a form POST with admin_password and
+// optionally user, action, from and until (dates like 2017-05-03, until is inclusive).
+func (u *Users) http_audit_log(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    if u.audit_log==nil{
+        http.Error(w, "There is no audit log", http.StatusNotFound)
+        return
+    }
+
+    filter:=Audit_filter{User: r.FormValue("user"), Action: r.FormValue("action")}
+    if r.FormValue("from")!=""{
+        filter.From, err=time.ParseInLocation("2006-01-02", r.FormValue("from"), time.Local)
+        if err!=nil{
+            http.Error(w, "from must be a date like 2017-05-03", http.StatusBadRequest)
+            return
+        }
+    }
+    if r.FormValue("until")!=""{
+        until, err:=time.ParseInLocation("2006-01-02", r.FormValue("until"), time.Local)
+        if err!=nil{
+            http.Error(w, "until must be a date like 2017-05-03", http.StatusBadRequest)
+            return
+        }
+        filter.Until=until.AddDate(0, 0, 1)
+    }
+
+    records, err:=u.audit_log.query(filter)
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    u.audit(r, "admin", "query_audit_log", r.FormValue("user"), "", "")
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(records)
+}
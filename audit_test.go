@@ -0,0 +1,109 @@
+package main;
+
+import "testing"
+import "os"
+import "time"
+
+func TestAudit_log(t *testing.T){
+    audit_log:=new_audit_log("DELETEME.log")
+
+    records, err:=audit_log.query(Audit_filter{})
+    if err!=nil || len(records)!=0{
+        t.Error()
+    }
+
+    day:=time.Date(2017, 5, 3, 12, 0, 0, 0, time.Local)
+    audit_log.append(Audit_record{day, "a", "add_entry", "a", "", "3.5.2017(4)", "127.0.0.1:1234"})
+    audit_log.append(Audit_record{day.AddDate(0, 0, 1), "admin", "delete_user", "b", "", "", ""})
+    audit_log.append(Audit_record{day.AddDate(0, 0, 2), "admin", "reset_password", "a", "", "", ""})
+
+    records, err=audit_log.query(Audit_filter{})
+    if err!=nil || len(records)!=3 || records[0].Remote_address!="127.0.0.1:1234" || !records[0].Time.Equal(day){
+        t.Error()
+    }
+
+    records, _=audit_log.query(Audit_filter{User: "a"})
+    if len(records)!=2{
+        t.Error()
+    }
+
+    records, _=audit_log.query(Audit_filter{Action: "delete_user"})
+    if len(records)!=1 || records[0].Target!="b"{
+        t.Error()
+    }
+
+    records, _=audit_log.query(Audit_filter{From: day.AddDate(0, 0, 1), Until: day.AddDate(0, 0, 2)})
+    if len(records)!=1 || records[0].Action!="delete_user"{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.log")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestUsersAudit(t *testing.T){
+    users:=new_users()
+    // Nothing happens without a log
+    users.audit(nil, "cli", "create_user", "a", "", "")
+
+    config:=default_config()
+    config.Audit_file="DELETEME.log"
+    users.configure(config)
+    users.audit(nil, "cli", "create_user", "a", "", "")
+
+    records, err:=users.audit_log.query(Audit_filter{})
+    if err!=nil || len(records)!=1 || records[0].Actor!="cli"{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.log")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestUsersAuditChanges(t *testing.T){
+    users:=new_users()
+    config:=default_config()
+    config.Audit_file="DELETEME.log"
+    users.configure(config)
+
+    // Changes are audited whoever makes them, failed ones are not
+    users.add_user(Actor{"cli", nil}, "a", "a password")
+    users.add_user(Actor{"cli", nil}, "a", "a password")
+    users.add_entry(Actor{"a", nil}, "a", Entry{2017,5,3,4})
+    users.apply_changes(Actor{"admin", nil}, []Change{Change{false, "a", Entry{2017,5,3,4}}, Change{true, "b", Entry{2017,5,3,5}}}, false)
+    users.rename_user(Actor{"admin", nil}, "a", "b")
+    users.remove_entries_before(Actor{"scheduler", nil}, Entry{2017,5,4,0})
+    users.add_entry(Actor{"b", nil}, "b", Entry{2017,5,2,4})
+    users.remove_entries_before(Actor{"scheduler", nil}, Entry{2017,5,4,0})
+
+    records, err:=users.audit_log.query(Audit_filter{})
+    if err!=nil || len(records)!=6{
+        t.Error(records)
+        return
+    }
+    entry:=Entry{2017,5,3,4}
+    old_entry:=Entry{2017,5,2,4}
+    expected:=[]Audit_record{
+        Audit_record{Actor: "cli", Action: "create_user", Target: "a"},
+        Audit_record{Actor: "a", Action: "add_entry", Target: "a", After: entry.String()},
+        Audit_record{Actor: "admin", Action: "remove_entry", Target: "a", Before: entry.String()},
+        Audit_record{Actor: "admin", Action: "rename_user", Target: "a", Before: "a", After: "b"},
+        Audit_record{Actor: "b", Action: "add_entry", Target: "b", After: old_entry.String()},
+        Audit_record{Actor: "scheduler", Action: "remove_old_entries", Before: "1 entries"},
+    }
+    for i,record:=range records{
+        record.Time=time.Time{}
+        if record!=expected[i]{
+            t.Error(record)
+        }
+    }
+
+    err=os.Remove("DELETEME.log")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
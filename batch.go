@@ -0,0 +1,94 @@
+package main;
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "os"
+
+// Adds and removes many entries with a single request (and a single write of the file).
+// Expects a POST with json data like:
+//     {"admin_password": "...", "all_or_nothing": true, "operations": [
+//         {"action": "add", "name": "101", "year": 2017, "month": 5, "day": 3, "slot": 10}, ...]}
+func (u *Users) http_batch(w http.ResponseWriter, r *http.Request){
+    type Operation struct{
+        Action string `json:"action"`
+        Name string `json:"name"`
+        Year int `json:"year"`
+        Month int `json:"month"`
+        Day int `json:"day"`
+        Slot int `json:"slot"`
+    }
+
+    type Result struct{
+        Ok bool `json:"ok"`
+        Error string `json:"error,omitempty"`
+    }
+
+    var to_get struct{
+        Admin_password string `json:"admin_password"`
+        All_or_nothing bool `json:"all_or_nothing"`
+        Operations []Operation `json:"operations"`
+    }
+
+    var to_send struct{
+        Return_code int `json:"return_code"`
+        Results []Result `json:"results"`
+    }
+
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    err:=json.NewDecoder(r.Body).Decode(&to_get)
+    if err!=nil{
+        http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+        return
+    }
+
+    err=u.authenticate(r, "admin", to_get.Admin_password)
+    if err!=nil{
+        to_send.Return_code=login_return_code(w, err)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(&to_send)
+        return
+    }
+
+    changes:=make([]Change, len(to_get.Operations))
+    for i,operation:=range to_get.Operations{
+        if operation.Action!="add" && operation.Action!="remove"{
+            http.Error(w, fmt.Sprintf("Operation %d: action must be \"add\" or \"remove\"", i), http.StatusBadRequest)
+            return
+        }
+        changes[i]=Change{operation.Action=="add", operation.Name, Entry{operation.Year, operation.Month, operation.Day, operation.Slot}}
+    }
+
+    errs:=u.apply_changes(Actor{"admin", r}, changes, to_get.All_or_nothing)
+    to_send.Results=make([]Result, len(errs))
+    applied:=0
+    for i,err:=range errs{
+        if err!=nil{
+            to_send.Results[i]=Result{false, err.Error()}
+        } else{
+            to_send.Results[i]=Result{true, ""}
+            applied++
+        }
+    }
+
+    // Save changes to file
+    if applied>0{
+        err=u.to_file(u.config.Data_file)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+        }
+    }
+    fmt.Println("Batch applied:", applied, "of", len(changes), "operations")
+
+    to_send.Return_code=20
+    if applied<len(changes){
+        // Some operations failed
+        to_send.Return_code=4
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&to_send)
+}
@@ -0,0 +1,214 @@
+package main;
+
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "os"
+import "sort"
+import "strings"
+import "time"
+
+// Length of a single slot (a day is split into 24 of them)
+const slot_duration=time.Hour
+
+// Serves each user's entries as an iCalendar (.ics) feed, protected by a per user token
+type Calendar struct{
+    users *Users
+    secret []byte
+}
+
+// Loads a secret from a file, creating it if the file does not exist yet
+func load_secret(filename string) ([]byte, error){
+    secret, err:=ioutil.ReadFile(filename)
+    if os.IsNotExist(err){
+        secret=make([]byte, 32)
+        _, err=rand.Read(secret)
+        if err!=nil{
+            return nil, err
+        }
+        err=ioutil.WriteFile(filename, secret, 0600)
+    }
+    if err!=nil{
+        return nil, err
+    }
+
+    if len(secret)==0{
+        return nil, fmt.Errorf("Secret file %s is empty", filename)
+    }
+    return secret, nil
+}
+
+// Loads the secret used to sign calendar tokens, creating it if the file does not exist yet
+func new_calendar(users *Users, secret_filename string) (Calendar, error){
+    secret, err:=load_secret(secret_filename)
+    if err!=nil{
+        return Calendar{nil, nil}, err
+    }
+    return Calendar{users, secret}, nil
+}
+
+// The password is part of the token, so changing it revokes previously handed out feeds
+func (c *Calendar) token(name, password string) string{
+    mac:=hmac.New(sha256.New, c.secret)
+    mac.Write([]byte(name))
+    mac.Write([]byte{0})
+    mac.Write([]byte(password))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Calendar) check_token(name, token string) bool{
+    password, err:=c.users.get_users_password(name)
+    if err!=nil{
+        return false
+    }
+
+    return hmac.Equal([]byte(c.token(name, password)), []byte(token))
+}
+
+// Returns the point in time at which an entry's slot starts
+func entry_start(entry Entry, location *time.Location) time.Time{
+    return time.Date(entry.Year, time.Month(entry.Month), entry.Day, entry.Slot, 0, 0, 0, location)
+}
+
+func escape_ical_text(text string) string{
+    replacer:=strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\n", "\\n")
+    return replacer.Replace(text)
+}
+
+// Lines longer than 75 octets must be folded (RFC 5545, section 3.1)
+func fold_ical_line(line string) string{
+    folded:=""
+    limit:=75
+    for len(line)>limit{
+        cut:=limit
+        // Do not split multi-byte characters
+        for cut>0 && line[cut]&0xC0==0x80{
+            cut--
+        }
+        folded+=line[:cut]+"\r\n "
+        line=line[cut:]
+        // Continuation lines start with a space, which counts towards the limit
+        limit=74
+    }
+    return folded+line
+}
+
+// Renders the entries of a user as an iCalendar document. Times are written in UTC,
+// so calendar applications convert them to whatever timezone the phone is in.
+func render_calendar(name string, entries []Entry, stamp time.Time, location *time.Location) string{
+    const ical_time_format="20060102T150405Z"
+    sorted_entries:=make([]Entry, len(entries))
+    copy(sorted_entries, entries)
+    sort.Slice(sorted_entries, func(i, j int) bool{
+        return entry_start(sorted_entries[i], location).Before(entry_start(sorted_entries[j], location))
+    })
+
+    lines:=[]string{
+        "BEGIN:VCALENDAR",
+        "VERSION:2.0",
+        "PRODID:-//kathrin//Laundry plan//EN",
+        "CALSCALE:GREGORIAN",
+        "METHOD:PUBLISH",
+        "X-WR-CALNAME:"+escape_ical_text("Laundry ("+name+")"),
+    }
+
+    for _,entry:=range sorted_entries{
+        start:=entry_start(entry, location)
+        lines=append(lines,
+            "BEGIN:VEVENT",
+            // The uid only depends on the entry and its owner, so it stays the same between requests
+            fmt.Sprintf("UID:%04d%02d%02d-%02d-%s@kathrin", entry.Year, entry.Month, entry.Day, entry.Slot, hex.EncodeToString([]byte(name))),
+            "DTSTAMP:"+stamp.UTC().Format(ical_time_format),
+            "DTSTART:"+start.UTC().Format(ical_time_format),
+            "DTEND:"+start.Add(slot_duration).UTC().Format(ical_time_format),
+            "SUMMARY:"+escape_ical_text("Laundry"),
+            "DESCRIPTION:"+escape_ical_text("Reserved by "+name),
+            "END:VEVENT",
+        )
+    }
+    lines=append(lines, "END:VCALENDAR")
+
+    for i:=0; i<len(lines); i++{
+        lines[i]=fold_ical_line(lines[i])
+    }
+
+    return strings.Join(lines, "\r\n")+"\r\n"
+}
+
+// Expects a path like /calendar/<name>.ics?token=<token>
+func (c *Calendar) http_calendar(w http.ResponseWriter, r *http.Request){
+    if r.Method!="GET"{
+        http.Error(w, "Request to this address must be GET.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    name:=strings.TrimPrefix(r.URL.Path, "/calendar/")
+    if !strings.HasSuffix(name, ".ics"){
+        http.NotFound(w, r)
+        return
+    }
+    name=strings.TrimSuffix(name, ".ics")
+
+    if !c.check_token(name, r.URL.Query().Get("token")){
+        http.Error(w, "Wrong token", http.StatusUnauthorized)
+        return
+    }
+
+    entries, err:=c.users.get_users_entries(name)
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write([]byte(render_calendar(name, entries, time.Now(), time.Local)))
+}
+
+// Hands out the feed's address to a user that knows its password
+func (c *Calendar) http_calendar_token(w http.ResponseWriter, r *http.Request){
+    var to_get struct{
+        Name string `json:"name"`
+        Password string `json:"password"`
+    }
+
+    var to_send struct{
+        Return_code int `json:"return_code"`
+        Url string `json:"url"`
+    }
+
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    err:=json.NewDecoder(r.Body).Decode(&to_get)
+    if err!=nil{
+        http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+        return
+    }
+
+    // See if the user exists and the password is correct, on error send error code
+    err=c.users.authenticate(r, to_get.Name, to_get.Password)
+    // Tokens are made from the password, which requests with an api key do not have
+    if err==nil && api_key_from_request(r)!=nil{
+        err=error_api_key_scope
+    }
+    if err!=nil{
+        to_send.Return_code=login_return_code(w, err)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(&to_send)
+        return
+    }
+
+    to_send.Return_code=20
+    to_send.Url=fmt.Sprintf("/calendar/%s.ics?token=%s", url.PathEscape(to_get.Name), c.token(to_get.Name, to_get.Password))
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&to_send)
+}
@@ -0,0 +1,95 @@
+package main;
+
+import "testing"
+import "os"
+import "strings"
+import "time"
+
+func TestRender_calendar(t *testing.T){
+    location:=time.FixedZone("UTC+2", 2*60*60)
+    stamp:=time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+    ics:=render_calendar("a;b", []Entry{Entry{2017,5,3,10}, Entry{2017,5,2,0}}, stamp, location)
+
+    if !strings.HasPrefix(ics, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(ics, "END:VCALENDAR\r\n"){
+        t.Error()
+    }
+
+    if strings.Count(ics, "BEGIN:VEVENT")!=2{
+        t.Error()
+    }
+
+    // Sorted chronologically and converted to UTC
+    first:=strings.Index(ics, "DTSTART:20170501T220000Z")
+    second:=strings.Index(ics, "DTSTART:20170503T080000Z")
+    if first<0 || second<0 || first>second{
+        t.Error(ics)
+    }
+
+    if !strings.Contains(ics, "DTEND:20170503T090000Z"){
+        t.Error()
+    }
+
+    if !strings.Contains(ics, "UID:20170503-10-613b62@kathrin"){
+        t.Error()
+    }
+
+    if !strings.Contains(ics, `Reserved by a\;b`){
+        t.Error()
+    }
+
+    // Same input, same output (uids stay stable)
+    if ics!=render_calendar("a;b", []Entry{Entry{2017,5,3,10}, Entry{2017,5,2,0}}, stamp, location){
+        t.Error()
+    }
+}
+
+func TestFold_ical_line(t *testing.T){
+    line:=strings.Repeat("a", 160)
+    folded:=fold_ical_line(line)
+    if strings.Replace(folded, "\r\n ", "", -1)!=line{
+        t.Error()
+    }
+
+    for _,part:=range strings.Split(folded, "\r\n"){
+        if len(part)>75{
+            t.Error()
+        }
+    }
+}
+
+func TestCalendarToken(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+
+    calendar, err:=new_calendar(&users, "DELETEME.secret")
+    if err!=nil{
+        t.Error(err)
+        return
+    }
+
+    token:=calendar.token("name", "password")
+    if !calendar.check_token("name", token){
+        t.Error()
+    }
+
+    if calendar.check_token("name", "") || calendar.check_token("gnome", token){
+        t.Error()
+    }
+
+    // The secret is read back from the file
+    other, err:=new_calendar(&users, "DELETEME.secret")
+    if err!=nil || !other.check_token("name", token){
+        t.Error()
+    }
+
+    // Changing the password invalidates the token
+    users.change_password(Actor{}, "name", "password", "otherpassword")
+    if calendar.check_token("name", token){
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.secret")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
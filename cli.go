@@ -0,0 +1,428 @@
+package main;
+
+import "encoding/csv"
+import "encoding/json"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "os"
+import "strconv"
+
+const cli_usage=`Usage: kathrin [command] [flags] [arguments]
+
+Commands:
+    serve                                       start the server (default)
+    provision [-format csv|json] [-update] <file>
+                                                create many users, prints their credentials
+    user add <name> [password]                  create a user (generates a password if none is given)
+    user remove <name>                          delete a user and its entries
+    user passwd <name> [password]               reset a user's password
+    user list                                   list the users
+    entries purge                               move entries of past days to the archive
+    entries export [-format csv|json]           print every entry
+    archive export [-user <name>] [-from <date>] [-until <date>] [-format csv|json]
+                                                print archived entries (dates like 2017-05-03)
+    data export [-format csv|json]              print users (with passwords), entries and settings
+    data import [-format csv|json] [-dry-run] <file>
+                                                merge exported data, prints what changes
+    db check                                    look for inconsistencies in the data
+
+Every command accepts -config <file> and the configuration flags (see "kathrin serve -h").
+Commands that change the data refuse to run while the server is running, use the admin
+pages then.
+`
+
+func run_cli(args []string) int{
+    if len(args)==0{
+        return run_serve(nil)
+    }
+
+    switch args[0]{
+    case "serve":
+        return run_serve(args[1:])
+    case "provision":
+        return run_provision(args[1:])
+    case "user":
+        return run_user_command(args[1:])
+    case "entries":
+        return run_entries_command(args[1:])
+    case "db":
+        return run_db_command(args[1:])
+    case "archive":
+        return run_archive_command(args[1:])
+    case "data":
+        return run_data_command(args[1:])
+    case "help", "-h", "-help", "--help":
+        fmt.Print(cli_usage)
+        return 0
+    }
+
+    fmt.Fprint(os.Stderr, cli_usage)
+    return 2
+}
+
+// Parses the configuration flags (and any flag added by add_flags) of a subcommand and
+// builds the configuration. Prints errors itself.
+func parse_cli_flags(name string, args []string, add_flags func(*flag.FlagSet)) (Config, []string, bool){
+    flags:=flag.NewFlagSet(name, flag.ContinueOnError)
+    get_config:=add_config_flags(flags)
+    if add_flags!=nil{
+        add_flags(flags)
+    }
+    if flags.Parse(args)!=nil{
+        return Config{}, nil, false
+    }
+
+    config, err:=get_config()
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return Config{}, nil, false
+    }
+    return config, flags.Args(), true
+}
+
+func run_serve(args []string) int{
+    config, args_left, ok:=parse_cli_flags("serve", args, nil)
+    if !ok || len(args_left)!=0{
+        return 2
+    }
+    return serve(config)
+}
+
+// Loads the data to change it: the data file stays locked until unlock is called
+func load_for_writing(config Config) (Users, func(), error){
+    unlock, err:=lock_data_file(config.Data_file)
+    if err!=nil{
+        return Users{}, nil, err
+    }
+
+    users, err:=load_users(config)
+    if os.IsNotExist(err){
+        users=new_users()
+        users.configure(config)
+    } else if err!=nil{
+        unlock()
+        return Users{}, nil, err
+    }
+
+    return users, unlock, nil
+}
+
+// Runs a change on the data and saves it. Prints the error (if any) and returns the exit status.
+func change_data(config Config, change func(users *Users) error) int{
+    users, unlock, err:=load_for_writing(config)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    defer unlock()
+
+    err=change(&users)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    users.Sort()
+    err=users.to_file(config.Data_file)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// Returns the given password or a generated one. The password policy is applied when
+// the password is set.
+func password_from_args(config Config, args []string) (string, bool, error){
+    if len(args)==0{
+        password, err:=config.generate_password()
+        return password, true, err
+    }
+    return args[0], false, nil
+}
+
+func run_user_command(args []string) int{
+    if len(args)==0{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    config, args_left, ok:=parse_cli_flags("user "+args[0], args[1:], nil)
+    if !ok{
+        return 2
+    }
+
+    switch{
+    case args[0]=="list" && len(args_left)==0:
+        users, err:=load_users(config)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        for _,user:=range users.get_user_list(){
+            if user.Disabled{
+                fmt.Println(user.Name, "(disabled)")
+            } else{
+                fmt.Println(user.Name)
+            }
+        }
+        return 0
+    case args[0]=="add" && (len(args_left)==1 || len(args_left)==2):
+        name:=args_left[0]
+        password, generated, err:=password_from_args(config, args_left[1:])
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        status:=change_data(config, func(users *Users) error{
+            return users.add_user(Actor{"cli", nil}, name, password)
+        })
+        if status==0 && generated{
+            fmt.Println(name, password)
+        }
+        return status
+    case args[0]=="remove" && len(args_left)==1:
+        return change_data(config, func(users *Users) error{
+            return users.remove_user(Actor{"cli", nil}, args_left[0])
+        })
+    case args[0]=="passwd" && (len(args_left)==1 || len(args_left)==2):
+        name:=args_left[0]
+        password, generated, err:=password_from_args(config, args_left[1:])
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        status:=change_data(config, func(users *Users) error{
+            return users.reset_password(Actor{"cli", nil}, name, password)
+        })
+        if status==0 && generated{
+            fmt.Println(name, password)
+        }
+        return status
+    }
+
+    fmt.Fprint(os.Stderr, cli_usage)
+    return 2
+}
+
+// Writes the bookings as csv (name, year, month, day, slot) or json
+func write_bookings(writer io.Writer, bookings []Booking, format string) error{
+    if format=="json"{
+        b, err:=json.MarshalIndent(bookings, "", "    ")
+        if err!=nil{
+            return err
+        }
+        _, err=writer.Write(append(b, '\n'))
+        return err
+    }
+
+    csv_writer:=csv.NewWriter(writer)
+    csv_writer.Write([]string{"name", "year", "month", "day", "slot"})
+    for _,booking:=range bookings{
+        entry:=booking.Entry
+        csv_writer.Write([]string{booking.Name, strconv.Itoa(entry.Year), strconv.Itoa(entry.Month), strconv.Itoa(entry.Day), strconv.Itoa(entry.Slot)})
+    }
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+func run_entries_command(args []string) int{
+    if len(args)==0{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    var format *string
+    config, args_left, ok:=parse_cli_flags("entries "+args[0], args[1:], func(flags *flag.FlagSet){
+        format=flags.String("format", "csv", "output format (csv or json)")
+    })
+    if !ok{
+        return 2
+    }
+
+    switch{
+    case args[0]=="purge" && len(args_left)==0:
+        return change_data(config, func(users *Users) error{
+            today, _:=day_in_the_future(0)
+            _, err:=users.archive_entries_before(Actor{"cli", nil}, today, users.archive)
+            return err
+        })
+    case args[0]=="export" && len(args_left)==0:
+        if *format!="csv" && *format!="json"{
+            fmt.Fprintln(os.Stderr, "Format must be csv or json")
+            return 2
+        }
+        users, err:=load_users(config)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        err=write_bookings(os.Stdout, users.get_bookings(), *format)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        return 0
+    }
+
+    fmt.Fprint(os.Stderr, cli_usage)
+    return 2
+}
+
+func run_db_command(args []string) int{
+    if len(args)==0 || args[0]!="check"{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    config, args_left, ok:=parse_cli_flags("db check", args[1:], nil)
+    if !ok || len(args_left)!=0{
+        return 2
+    }
+
+    users, err:=load_users(config)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    problems:=users.check()
+    for _,problem:=range problems{
+        fmt.Println(problem)
+    }
+    if len(problems)>0{
+        return 1
+    }
+
+    fmt.Println("No problems found in", config.Data_file, "-", users.Len(), "users")
+    return 0
+}
+
+func run_archive_command(args []string) int{
+    if len(args)==0 || args[0]!="export"{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    var format, user, from, until *string
+    config, args_left, ok:=parse_cli_flags("archive export", args[1:], func(flags *flag.FlagSet){
+        format=flags.String("format", "csv", "output format (csv or json)")
+        user=flags.String("user", "", "only entries of this user")
+        from=flags.String("from", "", "only entries of this day or later")
+        until=flags.String("until", "", "only entries of this day or earlier")
+    })
+    if !ok || len(args_left)!=0{
+        return 2
+    }
+    if *format!="csv" && *format!="json"{
+        fmt.Fprintln(os.Stderr, "Format must be csv or json")
+        return 2
+    }
+
+    filter:=Archive_filter{Name: *user}
+    var err error
+    filter.From, err=parse_day(*from)
+    if err==nil{
+        filter.Until, err=parse_day(*until)
+    }
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 2
+    }
+
+    bookings, err:=new_archive(config.Archive_dir).query(filter)
+    if err==nil{
+        err=write_archived_bookings(os.Stdout, bookings, *format)
+    }
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    return 0
+}
+
+func run_data_command(args []string) int{
+    if len(args)==0{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    var format *string
+    var dry_run *bool
+    config, args_left, ok:=parse_cli_flags("data "+args[0], args[1:], func(flags *flag.FlagSet){
+        format=flags.String("format", "json", "format of the data (csv or json)")
+        dry_run=flags.Bool("dry-run", false, "only show what an import would change")
+    })
+    if !ok{
+        return 2
+    }
+    if *format!="csv" && *format!="json"{
+        fmt.Fprintln(os.Stderr, "Format must be csv or json")
+        return 2
+    }
+
+    switch{
+    case args[0]=="export" && len(args_left)==0:
+        users, err:=load_users(config)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        err=write_dataset(os.Stdout, users.export_dataset(), *format)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        return 0
+    case args[0]=="import" && len(args_left)==1:
+        f, err:=os.Open(args_left[0])
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        dataset, err:=parse_dataset(f, *format)
+        f.Close()
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+
+        var report Import_report
+        status:=0
+        if *dry_run{
+            users, err:=load_users(config)
+            if os.IsNotExist(err){
+                users=new_users()
+                users.configure(config)
+            } else if err!=nil{
+                fmt.Fprintln(os.Stderr, err)
+                return 1
+            }
+            report=users.import_dataset(Actor{"cli", nil}, dataset, true)
+        } else{
+            status=change_data(config, func(users *Users) error{
+                report=users.import_dataset(Actor{"cli", nil}, dataset, false)
+                if !report.Applied{
+                    return errors.New("Nothing was imported because of conflicts")
+                }
+                return nil
+            })
+        }
+
+        b, err:=json.MarshalIndent(report, "", "    ")
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        fmt.Println(string(b))
+        if status==0 && len(report.Conflicts)>0{
+            status=1
+        }
+        return status
+    }
+
+    fmt.Fprint(os.Stderr, cli_usage)
+    return 2
+}
@@ -0,0 +1,59 @@
+package main;
+
+import "testing"
+import "bytes"
+import "encoding/json"
+import "os"
+
+func TestWrite_bookings(t *testing.T){
+    bookings:=[]Booking{Booking{"a", Entry{2017,2,3,4}}, Booking{"b,c", Entry{2017,2,3,5}}}
+
+    b:=bytes.Buffer{}
+    err:=write_bookings(&b, bookings, "csv")
+    if err!=nil || b.String()!="name,year,month,day,slot\na,2017,2,3,4\n\"b,c\",2017,2,3,5\n"{
+        t.Error(b.String())
+    }
+
+    b.Reset()
+    err=write_bookings(&b, bookings, "json")
+    if err!=nil{
+        t.Error(err)
+        return
+    }
+
+    read_bookings:=[]Booking{}
+    err=json.Unmarshal(b.Bytes(), &read_bookings)
+    if err!=nil || len(read_bookings)!=2 || read_bookings[1]!=bookings[1]{
+        t.Error()
+    }
+}
+
+func TestChange_data(t *testing.T){
+    config:=default_config()
+    config.Data_file="DELETEME.json"
+    status:=change_data(config, func(users *Users) error{
+        return users.add_user(Actor{}, "a", "a password")
+    })
+    if status!=0{
+        t.Error()
+    }
+
+    // The data file is locked while it is being changed
+    status=change_data(config, func(users *Users) error{
+        if change_data(config, func(users *Users) error{ return nil })==0{
+            t.Error()
+        }
+        return users.add_user(Actor{}, "a", "a password")
+    })
+    if status==0{
+        t.Error()
+    }
+
+    users, err:=from_file("DELETEME.json")
+    if err!=nil || users.Len()!=1{
+        t.Error()
+    }
+
+    os.Remove("DELETEME.json")
+    os.Remove("DELETEME.json.lock")
+}
@@ -0,0 +1,291 @@
+package main;
+
+import "encoding/json"
+import "errors"
+import "flag"
+import "fmt"
+import "os"
+import "reflect"
+import "strconv"
+import "strings"
+import "unicode"
+
+// Default file the configuration is read from (it does not need to exist)
+const default_config_filename="kathrin.json"
+
+// Everything that can be configured. Each field can be set (in increasing order of
+// precedence) in the configuration file with its json name, in the environment as
+// KATHRIN_<JSON NAME IN UPPER CASE> and with the flag -<json name>.
+type Config struct{
+    Address string `json:"address" help:"address the server listens on"`
+    Trusted_origins string `json:"trusted_origins" help:"comma separated origins (like https://example.com) besides the server's own that may post to it"`
+    Tls_cert_file string `json:"tls_cert_file" help:"certificate (chain) in PEM format, the server uses https if it is set"`
+    Tls_key_file string `json:"tls_key_file" help:"private key of the certificate in PEM format"`
+    Redirect_address string `json:"redirect_address" help:"address that redirects http requests to https, like \":80\" (empty to disable)"`
+    Hsts_max_age int `json:"hsts_max_age" help:"seconds browsers should only use https for the server (0 to disable)"`
+    Data_file string `json:"data_file" help:"file the users and their entries are stored in"`
+    Frontend_dir string `json:"frontend_dir" help:"directory with the html pages"`
+    Bootstrap_dir string `json:"bootstrap_dir" help:"directory with bootstrap's css, js and fonts"`
+    Idempotency_file string `json:"idempotency_file" help:"file the responses to retryable requests are stored in"`
+    Idempotency_secret_file string `json:"idempotency_secret_file" help:"file with the secret the retryable requests' data is hashed with"`
+    Calendar_secret_file string `json:"calendar_secret_file" help:"file with the secret calendar tokens are signed with"`
+    Audit_file string `json:"audit_file" help:"file every change is logged to (empty to disable)"`
+    Password_characters string `json:"password_characters" help:"characters generated passwords consist of"`
+    Min_password_length int `json:"min_password_length" help:"minimum length of a password in characters"`
+    Max_password_length int `json:"max_password_length" help:"maximum length of a password in characters"`
+    Password_classes string `json:"password_classes" help:"kinds of characters passwords may contain (letter, mark, digit, number, punct, symbol, space)"`
+    Password_denylist_file string `json:"password_denylist_file" help:"file with passwords that are too common to be used (empty to disable)"`
+    Password_history int `json:"password_history" help:"how many of a user's last passwords cannot be used again"`
+    Min_year int `json:"min_year" help:"entries before this year are rejected"`
+    Archive_dir string `json:"archive_dir" help:"directory old entries are moved to"`
+    Retention_days int `json:"retention_days" help:"days entries are kept after they are over"`
+    Cleanup_schedule string `json:"cleanup_schedule" help:"when old entries are archived, like \"daily 03:00\" or \"6h\" (empty to disable)"`
+    Reset_code_file string `json:"reset_code_file" help:"file the unused password reset codes are stored in"`
+    Reset_code_hours int `json:"reset_code_hours" help:"how long a password reset code can be used"`
+    Login_free_attempts int `json:"login_free_attempts" help:"failed logins before each further one has to wait twice as long"`
+    Login_lockout_attempts int `json:"login_lockout_attempts" help:"failed logins of an account before it is locked out"`
+    Login_address_lockout_attempts int `json:"login_address_lockout_attempts" help:"failed logins from an address before it is locked out"`
+    Login_lockout_minutes int `json:"login_lockout_minutes" help:"how long a lockout lasts"`
+    Api_key_file string `json:"api_key_file" help:"file the hashes of the issued api keys are stored in"`
+    Api_key_rate_per_minute int `json:"api_key_rate_per_minute" help:"requests per minute an api key may make unless it was issued with its own rate"`
+    Rate_limit_reads_per_minute int `json:"rate_limit_reads_per_minute" help:"reads per minute from one address, api key or user (0 for no limit)"`
+    Rate_limit_writes_per_minute int `json:"rate_limit_writes_per_minute" help:"writes per minute from one address, api key or user (0 for no limit)"`
+    Rate_limit_auth_per_minute int `json:"rate_limit_auth_per_minute" help:"password checks per minute from one address or for one user (0 for no limit)"`
+}
+
+func default_config() Config{
+    return Config{
+        Address: ":8000",
+        Hsts_max_age: 31536000,
+        Data_file: "users.json",
+        Frontend_dir: "frontend",
+        Bootstrap_dir: "bootstrap",
+        Idempotency_file: "idempotency.json",
+        Idempotency_secret_file: "idempotency_secret",
+        Calendar_secret_file: "calendar_secret",
+        Audit_file: "audit.log",
+        Password_characters: "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+        Min_password_length: 8,
+        Max_password_length: 128,
+        Password_classes: "letter,mark,digit,number,punct,symbol,space",
+        Password_denylist_file: "common_passwords.txt",
+        Password_history: 3,
+        Min_year: 2017,
+        Archive_dir: "archive",
+        Retention_days: 30,
+        Cleanup_schedule: "daily 03:00",
+        Reset_code_file: "reset_codes.json",
+        Reset_code_hours: 48,
+        Login_free_attempts: 3,
+        Login_lockout_attempts: 10,
+        Login_address_lockout_attempts: 50,
+        Login_lockout_minutes: 15,
+        Api_key_file: "api_keys.json",
+        Api_key_rate_per_minute: 60,
+        Rate_limit_reads_per_minute: 600,
+        Rate_limit_writes_per_minute: 60,
+        Rate_limit_auth_per_minute: 30,
+    }
+}
+
+func (c *Config) validate() error{
+    if c.Address==""{
+        return errors.New("address cannot be empty")
+    }
+    if (c.Tls_cert_file=="")!=(c.Tls_key_file==""){
+        return errors.New("tls_cert_file and tls_key_file must be set together")
+    }
+    if c.Redirect_address!="" && c.Tls_cert_file==""{
+        return errors.New("redirect_address needs tls_cert_file and tls_key_file")
+    }
+    if c.Hsts_max_age<0{
+        return errors.New("hsts_max_age cannot be negative")
+    }
+    if c.Data_file==""{
+        return errors.New("data_file cannot be empty")
+    }
+    if c.Password_characters==""{
+        return errors.New("password_characters cannot be empty")
+    }
+    if c.Min_password_length<1{
+        return errors.New("min_password_length must be at least 1")
+    }
+    if c.Max_password_length<c.Min_password_length{
+        return errors.New("max_password_length cannot be smaller than min_password_length")
+    }
+    classes, err:=parse_password_classes(c.Password_classes)
+    if err!=nil{
+        return fmt.Errorf("password_classes: %s", err)
+    }
+    for _,password_char:=range c.Password_characters{
+        if !unicode.IsOneOf(classes, password_char){
+            return fmt.Errorf("password_characters contains %q, which password_classes does not allow", password_char)
+        }
+    }
+    if c.Password_history<0{
+        return errors.New("password_history cannot be negative")
+    }
+    if c.Min_year<1{
+        return errors.New("min_year must be positive")
+    }
+    if c.Archive_dir==""{
+        return errors.New("archive_dir cannot be empty")
+    }
+    if c.Retention_days<0{
+        return errors.New("retention_days cannot be negative")
+    }
+    if c.Reset_code_hours<1{
+        return errors.New("reset_code_hours must be at least 1")
+    }
+    if c.Login_free_attempts<0{
+        return errors.New("login_free_attempts cannot be negative")
+    }
+    if c.Login_lockout_attempts<=c.Login_free_attempts || c.Login_address_lockout_attempts<=c.Login_free_attempts{
+        return errors.New("login_lockout_attempts and login_address_lockout_attempts must be larger than login_free_attempts")
+    }
+    if c.Login_lockout_minutes<1{
+        return errors.New("login_lockout_minutes must be at least 1")
+    }
+    if c.Api_key_rate_per_minute<1{
+        return errors.New("api_key_rate_per_minute must be at least 1")
+    }
+    if c.Rate_limit_reads_per_minute<0 || c.Rate_limit_writes_per_minute<0 || c.Rate_limit_auth_per_minute<0{
+        return errors.New("rate limits cannot be negative")
+    }
+    _, err=parse_schedule(c.Cleanup_schedule)
+    if err!=nil{
+        return fmt.Errorf("cleanup_schedule: %s", err)
+    }
+    return nil
+}
+
+// Sets the field with the given json name from a string
+func (c *Config) set(name, value string) error{
+    config:=reflect.ValueOf(c).Elem()
+    for i:=0; i<config.NumField(); i++{
+        if config.Type().Field(i).Tag.Get("json")!=name{
+            continue
+        }
+
+        field:=config.Field(i)
+        switch field.Kind(){
+        case reflect.String:
+            field.SetString(value)
+        case reflect.Int:
+            n, err:=strconv.Atoi(value)
+            if err!=nil{
+                return fmt.Errorf("%s must be a number", name)
+            }
+            field.SetInt(int64(n))
+        }
+        return nil
+    }
+
+    return fmt.Errorf("Unknown configuration option %s", name)
+}
+
+// Returns every option by its json name, as it would be given in the environment
+func (c *Config) values() map[string]string{
+    values:=make(map[string]string)
+    config:=reflect.ValueOf(c).Elem()
+    for i:=0; i<config.NumField(); i++{
+        values[config.Type().Field(i).Tag.Get("json")]=fmt.Sprint(config.Field(i).Interface())
+    }
+    return values
+}
+
+// Adds a -config flag and one flag per configuration option. The returned function builds
+// the configuration once the flags are parsed.
+func add_config_flags(flags *flag.FlagSet) func() (Config, error){
+    config_filename:=flags.String("config", "", "configuration file (default "+default_config_filename+", also KATHRIN_CONFIG)")
+    values:=make(map[string]*string)
+    defaults:=default_config()
+    config_type:=reflect.TypeOf(defaults)
+    for i:=0; i<config_type.NumField(); i++{
+        name:=config_type.Field(i).Tag.Get("json")
+        default_value:=fmt.Sprint(reflect.ValueOf(defaults).Field(i).Interface())
+        values[name]=flags.String(name, "", fmt.Sprintf("%s (default %q)", config_type.Field(i).Tag.Get("help"), default_value))
+    }
+
+    return func() (Config, error){
+        set_flags:=make(map[string]bool)
+        flags.Visit(func(f *flag.Flag){
+            set_flags[f.Name]=true
+        })
+
+        filename:=*config_filename
+        if filename==""{
+            filename=os.Getenv("KATHRIN_CONFIG")
+        }
+
+        flag_values:=make(map[string]string)
+        for name,value:=range values{
+            if set_flags[name]{
+                flag_values[name]=*value
+            }
+        }
+
+        return load_config(filename, os.Getenv, flag_values)
+    }
+}
+
+// Builds the configuration from the defaults, a file (if no filename is given, the default
+// one is read if it exists), the environment and flags, in that order.
+func load_config(filename string, getenv func(string) string, flag_values map[string]string) (Config, error){
+    config:=default_config()
+
+    optional:=filename==""
+    if optional{
+        filename=default_config_filename
+    }
+    f, err:=os.Open(filename)
+    if err==nil{
+        decoder:=json.NewDecoder(f)
+        decoder.DisallowUnknownFields()
+        err=decoder.Decode(&config)
+        f.Close()
+        if err!=nil{
+            return Config{}, fmt.Errorf("%s: %s", filename, err)
+        }
+    } else if !(optional && os.IsNotExist(err)){
+        return Config{}, err
+    }
+
+    config_type:=reflect.TypeOf(config)
+    for i:=0; i<config_type.NumField(); i++{
+        name:=config_type.Field(i).Tag.Get("json")
+        value:=getenv("KATHRIN_"+strings.ToUpper(name))
+        if value==""{
+            continue
+        }
+        err=config.set(name, value)
+        if err!=nil{
+            return Config{}, fmt.Errorf("KATHRIN_%s: %s", strings.ToUpper(name), err)
+        }
+    }
+
+    for name,value:=range flag_values{
+        err=config.set(name, value)
+        if err!=nil{
+            return Config{}, fmt.Errorf("-%s: %s", name, err)
+        }
+    }
+
+    err=config.validate()
+    if err!=nil{
+        return Config{}, err
+    }
+    return config, nil
+}
+
+// Generates a password of password_characters as long as the password policy allows
+func (c *Config) generate_password() (string, error){
+    length:=generated_password_length
+    if length<c.Min_password_length{
+        length=c.Min_password_length
+    }
+    if length>c.Max_password_length{
+        length=c.Max_password_length
+    }
+    return random_string([]rune(c.Password_characters), length)
+}
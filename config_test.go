@@ -0,0 +1,96 @@
+package main;
+
+import "testing"
+import "flag"
+import "io/ioutil"
+import "os"
+import "strings"
+
+func TestLoad_config(t *testing.T){
+    config, err:=load_config("", func(string) string{ return "" }, nil)
+    if err!=nil || config!=default_config(){
+        t.Error()
+    }
+
+    err=ioutil.WriteFile("DELETEME.json", []byte(`{"address": ":9000", "data_file": "file.json", "min_year": 2000}`), 0644)
+    if err!=nil{
+        panic("Could not create temporary file")
+    }
+
+    // Flags override the environment, which overrides the file
+    env:=map[string]string{"KATHRIN_DATA_FILE": "env.json", "KATHRIN_MIN_YEAR": "2010"}
+    config, err=load_config("DELETEME.json", func(name string) string{ return env[name] }, map[string]string{"min_year": "2015"})
+    if err!=nil{
+        t.Error(err)
+    }
+    if config.Address!=":9000" || config.Data_file!="env.json" || config.Min_year!=2015 || config.Frontend_dir!="frontend"{
+        t.Error(config)
+    }
+
+    // Invalid values
+    _, err=load_config("DELETEME.json", func(string) string{ return "" }, map[string]string{"min_year": "a"})
+    if err==nil{
+        t.Error()
+    }
+    _, err=load_config("DELETEME.json", func(string) string{ return "" }, map[string]string{"max_password_length": "2"})
+    if err==nil{
+        t.Error()
+    }
+
+    // Unknown options in the file
+    ioutil.WriteFile("DELETEME.json", []byte(`{"adress": ":9000"}`), 0644)
+    _, err=load_config("DELETEME.json", func(string) string{ return "" }, nil)
+    if err==nil{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+
+    // A file that was asked for must exist
+    _, err=load_config("DELETEME.json", func(string) string{ return "" }, nil)
+    if err==nil{
+        t.Error()
+    }
+}
+
+func TestAdd_config_flags(t *testing.T){
+    flags:=flag.NewFlagSet("test", flag.ContinueOnError)
+    get_config:=add_config_flags(flags)
+    err:=flags.Parse([]string{"-address", ":9000", "-max_password_length", "64", "rest"})
+    if err!=nil{
+        t.Error(err)
+        return
+    }
+
+    config, err:=get_config()
+    if err!=nil || config.Address!=":9000" || config.Max_password_length!=64 || config.Data_file!="users.json"{
+        t.Error()
+    }
+
+    if len(flags.Args())!=1{
+        t.Error()
+    }
+}
+
+func TestConfigGenerate_password(t *testing.T){
+    config:=default_config()
+    config.Password_characters="äb"
+    config.Min_password_length=12
+    password, err:=config.generate_password()
+    if err!=nil || len([]rune(password))!=12 || strings.Trim(password, "äb")!=""{
+        t.Error(password)
+    }
+
+    // Generated passwords must be allowed by the policy
+    config.Password_classes="digit"
+    if config.validate()==nil{
+        t.Error()
+    }
+    config.Password_classes="letter,smiley"
+    if config.validate()==nil{
+        t.Error()
+    }
+}
@@ -0,0 +1,129 @@
+package main;
+
+import "bytes"
+import "crypto/rand"
+import "crypto/subtle"
+import "encoding/hex"
+import "io/ioutil"
+import "net/http"
+import "net/url"
+import "strings"
+
+// Name of the cookie and of the form field that carry the csrf token
+const csrf_token_name="csrf_token"
+
+// Largest request body the csrf check reads to find the token
+const max_csrf_form_size=10<<20
+
+// Keeps other sites from making browsers send requests that change something. Every
+// request that is not a GET, HEAD or OPTIONS must come from a page of this server (going
+// by its Origin or Referer header) and form posts must also carry the token from the
+// csrf_token cookie in their csrf_token field (csrf.js adds it to every form).
+type Csrf_guard struct{
+    // Hosts (with port, if any) pages may be served from besides the request's own
+    trusted_hosts map[string]bool
+}
+
+// Takes a comma separated list of origins like https://example.com:8443
+func new_csrf_guard(trusted_origins string) *Csrf_guard{
+    guard:=&Csrf_guard{make(map[string]bool)}
+    for _,origin:=range strings.Split(trusted_origins, ","){
+        origin_url, err:=url.Parse(strings.TrimSpace(origin))
+        if err==nil && origin_url.Host!=""{
+            guard.trusted_hosts[origin_url.Host]=true
+        }
+    }
+    return guard
+}
+
+// Sets a cookie only sent along with requests from this site. Once there are sessions,
+// their cookies should be made here too.
+func set_cookie(w http.ResponseWriter, r *http.Request, name string, value string, http_only bool){
+    http.SetCookie(w, &http.Cookie{
+        Name: name,
+        Value: value,
+        Path: "/",
+        HttpOnly: http_only,
+        Secure: r.TLS!=nil,
+        SameSite: http.SameSiteStrictMode,
+    })
+}
+
+// Whether the request was sent by a page of this server. Requests without Origin and
+// Referer do not come from browsers, which always send one of them for cross site posts.
+func (g *Csrf_guard) same_origin(r *http.Request) bool{
+    source:=r.Header.Get("Origin")
+    if source=="" || source=="null"{
+        source=r.Header.Get("Referer")
+    }
+    if source==""{
+        return r.Header.Get("Origin")==""
+    }
+
+    source_url, err:=url.Parse(source)
+    if err!=nil{
+        return false
+    }
+    return source_url.Host==r.Host || g.trusted_hosts[source_url.Host]
+}
+
+// Checks the form's token against the cookie without consuming the body, which the
+// handler (and the idempotency cache) still need
+func csrf_token_matches(r *http.Request) bool{
+    cookie, err:=r.Cookie(csrf_token_name)
+    if err!=nil || cookie.Value==""{
+        return false
+    }
+
+    body, err:=ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, max_csrf_form_size))
+    if err!=nil{
+        return false
+    }
+    r.Body=ioutil.NopCloser(bytes.NewReader(body))
+
+    form_request:=r.WithContext(r.Context())
+    form_request.Body=ioutil.NopCloser(bytes.NewReader(body))
+    form_request.Form=nil
+    form_request.PostForm=nil
+    form_request.MultipartForm=nil
+    token:=form_request.PostFormValue(csrf_token_name)
+
+    return subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value))==1
+}
+
+func (g *Csrf_guard) wrap(handler http.Handler) http.Handler{
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        if r.Method=="GET" || r.Method=="HEAD" || r.Method=="OPTIONS"{
+            // Pages get the token their forms have to send back
+            if _,err:=r.Cookie(csrf_token_name);err!=nil{
+                token:=make([]byte, 32)
+                _, err=rand.Read(token)
+                if err==nil{
+                    set_cookie(w, r, csrf_token_name, hex.EncodeToString(token), false)
+                }
+            }
+            handler.ServeHTTP(w, r)
+            return
+        }
+
+        // Browsers cannot send api key headers to other sites without asking them first
+        if api_key_header(r)!=""{
+            handler.ServeHTTP(w, r)
+            return
+        }
+
+        if !g.same_origin(r){
+            http.Error(w, "Requests from other sites are not accepted", http.StatusForbidden)
+            return
+        }
+
+        content_type:=r.Header.Get("Content-Type")
+        is_form:=strings.HasPrefix(content_type, "application/x-www-form-urlencoded") || strings.HasPrefix(content_type, "multipart/form-data")
+        if is_form && !csrf_token_matches(r){
+            http.Error(w, "The form is outdated, reload the page and try again", http.StatusForbidden)
+            return
+        }
+
+        handler.ServeHTTP(w, r)
+    })
+}
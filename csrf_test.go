@@ -0,0 +1,72 @@
+package main;
+
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+func TestCsrf_guard(t *testing.T){
+    var body string
+    handler:=new_csrf_guard("https://trusted.example.com, not an origin").wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        b, _:=ioutil.ReadAll(r.Body)
+        body=string(b)
+    }))
+    send:=func(method, content_type, data string, headers map[string]string) *httptest.ResponseRecorder{
+        r:=httptest.NewRequest(method, "http://kathrin.example.com/see_all", strings.NewReader(data))
+        r.Header.Set("Content-Type", content_type)
+        for name,value:=range headers{
+            r.Header.Set(name, value)
+        }
+        w:=httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        return w
+    }
+
+    // Pages hand out the token
+    w:=send("GET", "", "", nil)
+    cookies:=w.Result().Cookies()
+    if w.Code!=200 || len(cookies)!=1 || cookies[0].Name!=csrf_token_name || cookies[0].SameSite!=http.SameSiteStrictMode || cookies[0].HttpOnly{
+        t.Error(cookies)
+    }
+    token:=cookies[0].Value
+    if len(send("GET", "", "", map[string]string{"Cookie": "csrf_token="+token}).Result().Cookies())!=0{
+        t.Error()
+    }
+
+    form:="admin_password=x&csrf_token="+token
+    same_site:=map[string]string{"Origin": "http://kathrin.example.com", "Cookie": "csrf_token="+token}
+    if send("POST", "application/x-www-form-urlencoded", form, same_site).Code!=200 || body!=form{
+        t.Error(body)
+    }
+
+    // Forms without the token, or with another one
+    if send("POST", "application/x-www-form-urlencoded", "admin_password=x", same_site).Code!=403{
+        t.Error()
+    }
+    if send("POST", "application/x-www-form-urlencoded", form, map[string]string{"Cookie": "csrf_token=other"}).Code!=403{
+        t.Error()
+    }
+
+    // Origins
+    json:=`{"name": "a"}`
+    if send("POST", "application/json", json, map[string]string{"Origin": "http://evil.example.com"}).Code!=403{
+        t.Error()
+    }
+    if send("POST", "text/plain", json, map[string]string{"Referer": "http://evil.example.com/page"}).Code!=403{
+        t.Error()
+    }
+    if send("POST", "application/json", json, map[string]string{"Origin": "null"}).Code!=403{
+        t.Error()
+    }
+    if send("POST", "application/json", json, map[string]string{"Referer": "http://kathrin.example.com/"}).Code!=200{
+        t.Error()
+    }
+    if send("POST", "application/json", json, map[string]string{"Origin": "https://trusted.example.com"}).Code!=200{
+        t.Error()
+    }
+    // Not from a browser
+    if send("POST", "application/json", json, nil).Code!=200 || body!=json{
+        t.Error()
+    }
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package main;
+
+import "errors"
+import "os"
+import "syscall"
+
+// Takes an exclusive lock on a file next to the data file, so that the server and the
+// command line tools never write the data at the same time. The lock is held until the
+// returned function is called (or the process ends).
+func lock_data_file(filename string) (func(), error){
+    f, err:=os.OpenFile(filename+".lock", os.O_CREATE|os.O_RDWR, 0600)
+    if err!=nil{
+        return nil, err
+    }
+
+    err=syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+    if err!=nil{
+        f.Close()
+        if err==syscall.EWOULDBLOCK{
+            return nil, errors.New("Data file "+filename+" is in use (is the server running?)")
+        }
+        return nil, err
+    }
+
+    return func(){
+        f.Close()
+    }, nil
+}
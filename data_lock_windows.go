@@ -0,0 +1,24 @@
+//go:build windows
+// +build windows
+
+package main;
+
+import "errors"
+import "os"
+
+// Creating the file fails if it exists, which is as close to a lock as it gets without
+// system calls. A stale lock file (left behind by a crash) has to be removed by hand.
+func lock_data_file(filename string) (func(), error){
+    f, err:=os.OpenFile(filename+".lock", os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+    if os.IsExist(err){
+        return nil, errors.New("Data file "+filename+" is in use (is the server running?)")
+    }
+    if err!=nil{
+        return nil, err
+    }
+
+    return func(){
+        f.Close()
+        os.Remove(filename+".lock")
+    }, nil
+}
@@ -0,0 +1,445 @@
+package main;
+
+import "encoding/csv"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+import "time"
+
+// Increased whenever the format of exported datasets changes
+const dataset_version=1
+
+type Dataset_user struct{
+    Name string `json:"name"`
+    Password string `json:"password"`
+    Disabled bool `json:"disabled,omitempty"`
+}
+
+// Everything needed to move the data to another instance
+type Dataset struct{
+    Version int `json:"version"`
+    Exported time.Time `json:"exported"`
+    // Configuration options by their json name. They are only compared on import, the
+    // configuration itself comes from files, the environment and flags.
+    Settings map[string]string `json:"settings,omitempty"`
+    Users []Dataset_user `json:"users"`
+    Bookings []Booking `json:"bookings"`
+}
+
+// What an import changes (or would change, on a dry run). Nothing is applied if there
+// are conflicts.
+type Import_report struct{
+    Version int `json:"version"`
+    Dry_run bool `json:"dry_run"`
+    Applied bool `json:"applied"`
+    Users_added []string `json:"users_added"`
+    Passwords_changed []string `json:"passwords_changed"`
+    Users_disabled []string `json:"users_disabled"`
+    Users_enabled []string `json:"users_enabled"`
+    Users_unchanged int `json:"users_unchanged"`
+    // Users that are left as they are, like an admin with another password (every
+    // instance has its own)
+    Users_skipped []string `json:"users_skipped"`
+    Bookings_added []Booking `json:"bookings_added"`
+    Bookings_unchanged int `json:"bookings_unchanged"`
+    Conflicts []string `json:"conflicts"`
+    Settings_differing []string `json:"settings_differing"`
+}
+
+func (u *Users) export_dataset() Dataset{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    dataset:=Dataset{dataset_version, time.Now(), u.config.values(), []Dataset_user{}, []Booking{}}
+    for _,user:=range u.users{
+        dataset.Users=append(dataset.Users, Dataset_user{user.Name, user.Password, user.Disabled})
+        for _,entry:=range user.Entries{
+            dataset.Bookings=append(dataset.Bookings, Booking{user.Name, entry})
+        }
+    }
+    sort.SliceStable(dataset.Bookings, func(i, j int) bool{
+        return dataset.Bookings[i].Entry.Before(dataset.Bookings[j].Entry)
+    })
+    return dataset
+}
+
+// Merges a dataset into the users: users that do not exist are added, passwords and the
+// disabled flag are taken from the dataset and bookings are added. Users and bookings
+// missing from the dataset are left alone. Nothing is changed on a dry run or if there
+// are conflicts.
+func (u *Users) import_dataset(actor Actor, dataset Dataset, dry_run bool) (report Import_report){
+    defer func(){
+        audit_import(u, actor, report)
+    }()
+
+    // New passwords of existing users are checked against their history and the old ones
+    // hashed before the lock is taken, as that is slow
+    password_changes:=make([]Password_change, len(dataset.Users))
+    change_errors:=make([]error, len(dataset.Users))
+    for i,user:=range dataset.Users{
+        current, err:=u.get_user_copy(user.Name)
+        if err==nil && user.Password!="" && current.Password!=user.Password{
+            password_changes[i], change_errors[i]=u.password_policy.prepare(user.Password, &current)
+        }
+    }
+
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    report=Import_report{
+        Version: dataset.Version,
+        Dry_run: dry_run,
+        Users_added: []string{},
+        Passwords_changed: []string{},
+        Users_disabled: []string{},
+        Users_enabled: []string{},
+        Users_skipped: []string{},
+        Bookings_added: []Booking{},
+        Conflicts: []string{},
+        Settings_differing: []string{},
+    }
+
+    current:=u.config.values()
+    for name,value:=range dataset.Settings{
+        current_value, ok:=current[name]
+        if !ok{
+            report.Settings_differing=append(report.Settings_differing, fmt.Sprintf("%s is not known here", name))
+        } else if current_value!=value{
+            report.Settings_differing=append(report.Settings_differing, fmt.Sprintf("%s is %q here but %q in the import", name, current_value, value))
+        }
+    }
+    sort.Strings(report.Settings_differing)
+
+    existing:=make(map[string]int)
+    for i,user:=range u.users{
+        existing[user.Name]=i
+    }
+    imported:=make(map[string]bool)
+    skipped:=make(map[string]bool)
+    for j,user:=range dataset.Users{
+        if user.Name=="" || user.Password==""{
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("User %q has no name or no password", user.Name))
+            continue
+        }
+        if imported[user.Name]{
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("User %q appears more than once", user.Name))
+            continue
+        }
+        imported[user.Name]=true
+
+        i, ok:=existing[user.Name]
+        // The same rules as for the admin pages apply, the admin keeps its password and
+        // stays enabled
+        if user.Name=="admin" && (user.Disabled || (ok && u.users[i].Password!=user.Password)){
+            report.Users_skipped=append(report.Users_skipped, user.Name)
+            skipped[user.Name]=true
+            continue
+        }
+        if !ok{
+            err:=u.password_policy.validate(user.Password, nil)
+            if err!=nil{
+                report.Conflicts=append(report.Conflicts, fmt.Sprintf("Password of %q: %s", user.Name, err))
+                continue
+            }
+            report.Users_added=append(report.Users_added, user.Name)
+            continue
+        }
+        changed:=false
+        if u.users[i].Password!=user.Password{
+            err:=change_errors[j]
+            if err==nil && password_changes[j].replaces!=u.users[i].Password{
+                err=error_password_changed
+            }
+            if err!=nil{
+                report.Conflicts=append(report.Conflicts, fmt.Sprintf("Password of %q: %s", user.Name, err))
+                continue
+            }
+            report.Passwords_changed=append(report.Passwords_changed, user.Name)
+            changed=true
+        }
+        if !u.users[i].Disabled && user.Disabled{
+            report.Users_disabled=append(report.Users_disabled, user.Name)
+            changed=true
+        }
+        if u.users[i].Disabled && !user.Disabled{
+            report.Users_enabled=append(report.Users_enabled, user.Name)
+            changed=true
+        }
+        if !changed{
+            report.Users_unchanged++
+        }
+    }
+
+    booked:=make(map[Entry]string)
+    for _,booking:=range dataset.Bookings{
+        entry:=booking.Entry
+        if !entry_is_valid(entry, u.config.Min_year){
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("Booking of %q on %v is not valid", booking.Name, entry))
+            continue
+        }
+        if _,ok:=existing[booking.Name];!ok && (!imported[booking.Name] || skipped[booking.Name]){
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("Booking of %q on %v belongs to no user", booking.Name, entry))
+            continue
+        }
+        if name,ok:=booked[entry];ok{
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("%v is booked by both %q and %q in the import", entry, name, booking.Name))
+            continue
+        }
+        booked[entry]=booking.Name
+
+        name, ok:=u.entry_to_user[entry]
+        if ok && name==booking.Name{
+            report.Bookings_unchanged++
+        } else if ok{
+            report.Conflicts=append(report.Conflicts, fmt.Sprintf("%v is booked by %q here but by %q in the import", entry, name, booking.Name))
+        } else{
+            report.Bookings_added=append(report.Bookings_added, booking)
+        }
+    }
+
+    if dry_run || len(report.Conflicts)>0{
+        return report
+    }
+
+    for j,user:=range dataset.Users{
+        if skipped[user.Name]{
+            continue
+        }
+        i, ok:=existing[user.Name]
+        if !ok{
+            u.users=append(u.users, User{user.Name, user.Password, []Entry{}, user.Disabled, nil})
+            existing[user.Name]=len(u.users)-1
+            continue
+        }
+        if u.users[i].Password!=user.Password{
+            // Cannot fail, the change was checked above
+            u.password_policy.set_password(&u.users[i], password_changes[j])
+        }
+        u.users[i].Disabled=user.Disabled
+    }
+    changes:=[]Change{}
+    for _,booking:=range report.Bookings_added{
+        // Cannot fail, every booking was checked above
+        u.add_entry_locked(booking.Name, booking.Entry)
+        changes=append(changes, Change{true, booking.Name, booking.Entry})
+    }
+    u.notify(changes)
+    report.Applied=true
+    return report
+}
+
+// Writes a dataset as json or as csv with one record per line:
+//     version,<version>,<exported>
+//     setting,<name>,<value>
+//     user,<name>,<password>,<disabled>
+//     booking,<name>,<year>,<month>,<day>,<slot>
+func write_dataset(writer io.Writer, dataset Dataset, format string) error{
+    if format=="json"{
+        b, err:=json.MarshalIndent(dataset, "", "    ")
+        if err!=nil{
+            return err
+        }
+        _, err=writer.Write(append(b, '\n'))
+        return err
+    }
+
+    csv_writer:=csv.NewWriter(writer)
+    csv_writer.Write([]string{"version", strconv.Itoa(dataset.Version), dataset.Exported.Format(time.RFC3339)})
+    names:=[]string{}
+    for name:=range dataset.Settings{
+        names=append(names, name)
+    }
+    sort.Strings(names)
+    for _,name:=range names{
+        csv_writer.Write([]string{"setting", name, dataset.Settings[name]})
+    }
+    for _,user:=range dataset.Users{
+        csv_writer.Write([]string{"user", user.Name, user.Password, strconv.FormatBool(user.Disabled)})
+    }
+    for _,booking:=range dataset.Bookings{
+        entry:=booking.Entry
+        csv_writer.Write([]string{"booking", booking.Name, strconv.Itoa(entry.Year), strconv.Itoa(entry.Month), strconv.Itoa(entry.Day), strconv.Itoa(entry.Slot)})
+    }
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+func parse_dataset_csv(reader io.Reader) (Dataset, error){
+    csv_reader:=csv.NewReader(reader)
+    csv_reader.FieldsPerRecord=-1
+    records, err:=csv_reader.ReadAll()
+    if err!=nil{
+        return Dataset{}, err
+    }
+
+    dataset:=Dataset{Settings: make(map[string]string), Users: []Dataset_user{}, Bookings: []Booking{}}
+    for i,record:=range records{
+        line_error:=fmt.Errorf("Line %d: expected a version, setting, user or booking record", i+1)
+        if i==0 && record[0]!="version"{
+            return Dataset{}, errors.New("Line 1: expected the version")
+        }
+
+        switch{
+        case record[0]=="version" && len(record)==3 && i==0:
+            dataset.Version, err=strconv.Atoi(record[1])
+            if err==nil{
+                dataset.Exported, err=time.Parse(time.RFC3339, record[2])
+            }
+        case record[0]=="setting" && len(record)==3:
+            dataset.Settings[record[1]]=record[2]
+        case record[0]=="user" && len(record)==4:
+            user:=Dataset_user{Name: record[1], Password: record[2]}
+            user.Disabled, err=strconv.ParseBool(record[3])
+            dataset.Users=append(dataset.Users, user)
+        case record[0]=="booking" && len(record)==6:
+            numbers:=[4]int{}
+            for j:=0; j<4 && err==nil; j++{
+                numbers[j], err=strconv.Atoi(record[j+2])
+            }
+            dataset.Bookings=append(dataset.Bookings, Booking{record[1], Entry{numbers[0], numbers[1], numbers[2], numbers[3]}})
+        default:
+            return Dataset{}, line_error
+        }
+        if err!=nil{
+            return Dataset{}, fmt.Errorf("Line %d: %s", i+1, err)
+        }
+    }
+
+    return dataset, nil
+}
+
+// Reads a dataset written by write_dataset, refusing versions this program does not know
+func parse_dataset(reader io.Reader, format string) (Dataset, error){
+    var dataset Dataset
+    var err error
+    switch format{
+    case "json":
+        err=json.NewDecoder(reader).Decode(&dataset)
+    case "csv", "":
+        dataset, err=parse_dataset_csv(reader)
+    default:
+        return Dataset{}, errors.New("Format must be csv or json")
+    }
+    if err!=nil{
+        return Dataset{}, err
+    }
+
+    if dataset.Version<1 || dataset.Version>dataset_version{
+        return Dataset{}, fmt.Errorf("Datasets of version %d cannot be imported (up to %d can)", dataset.Version, dataset_version)
+    }
+    return dataset, nil
+}
+
+// Writes records of what an import changed to the audit log
+func audit_import(u *Users, actor Actor, report Import_report){
+    if !report.Applied{
+        return
+    }
+    u.audit(actor.Request, actor.Name, "import_data", "", "", fmt.Sprintf("%d users added, %d passwords changed, %d bookings added", len(report.Users_added), len(report.Passwords_changed), len(report.Bookings_added)))
+}
+
+// Sends everything, passwords included. Expects a form POST with admin_password, confirm
+// set to raw_export_confirmation and optionally format (json or csv).
+func (u *Users) http_export_data(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // The passwords are not handed to keys
+    if api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    if r.FormValue("confirm")!=raw_export_confirmation{
+        http.Error(w, fmt.Sprintf("The export includes every password, type %q to confirm", raw_export_confirmation), http.StatusBadRequest)
+        return
+    }
+
+    format:=r.FormValue("format")
+    if format==""{
+        format="json"
+    }
+    if format!="json" && format!="csv"{
+        http.Error(w, "format must be json or csv", http.StatusBadRequest)
+        return
+    }
+
+    dataset:=u.export_dataset()
+    fmt.Println("Data exported")
+    u.audit(r, "admin", "export_data", "", "", "")
+
+    if format=="csv"{
+        w.Header().Set("Content-Type", "text/csv")
+    } else{
+        w.Header().Set("Content-Type", "application/json")
+    }
+    w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"kathrin-%s.%s\"", dataset.Exported.Format("2006-01-02"), format))
+    w.Header().Set("Cache-Control", "no-store")
+    write_dataset(w, dataset, format)
+}
+
+// Expects a form POST with admin_password, format (csv or json), data and optionally
+// dry_run. Answers with the import report as json.
+func (u *Users) http_import_data(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // Imports can change passwords, which keys are not allowed to do
+    if api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    dataset, err:=parse_dataset(strings.NewReader(r.FormValue("data")), r.FormValue("format"))
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    report:=u.import_dataset(Actor{"admin", r}, dataset, r.FormValue("dry_run")!="")
+    if report.Applied{
+        u.Sort()
+        // Save changes to file
+        err=u.to_file(u.config.Data_file)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+        }
+        fmt.Println("Data imported")
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    if len(report.Conflicts)>0{
+        w.WriteHeader(http.StatusConflict)
+    }
+    json.NewEncoder(w).Encode(&report)
+}
@@ -0,0 +1,156 @@
+package main;
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestDatasetRoundtrip(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_user(Actor{}, "b", "secret")
+    users.set_user_disabled(Actor{}, "b", true)
+    users.add_entry(Actor{}, "a", Entry{2017,5,3,4})
+    users.add_entry(Actor{}, "b", Entry{2017,5,2,4})
+
+    dataset:=users.export_dataset()
+    if dataset.Version!=dataset_version || len(dataset.Users)!=2 || len(dataset.Bookings)!=2 || dataset.Bookings[0].Name!="b" || dataset.Settings["min_year"]!="2017"{
+        t.Error(dataset)
+    }
+
+    for _,format:=range []string{"csv", "json"}{
+        buffer:=bytes.Buffer{}
+        err:=write_dataset(&buffer, dataset, format)
+        if err!=nil{
+            t.Error(err)
+        }
+        parsed, err:=parse_dataset(&buffer, format)
+        if err!=nil{
+            t.Error(format, err)
+            continue
+        }
+        if parsed.Version!=dataset.Version || parsed.Exported.Unix()!=dataset.Exported.Unix() || len(parsed.Users)!=2 || parsed.Users[1]!=dataset.Users[1] || len(parsed.Bookings)!=2 || parsed.Bookings[1]!=dataset.Bookings[1] || parsed.Settings["min_year"]!="2017"{
+            t.Error(format, parsed)
+        }
+    }
+}
+
+func TestParse_dataset(t *testing.T){
+    _, err:=parse_dataset(strings.NewReader(`{"version": 2, "users": [], "bookings": []}`), "json")
+    if err==nil{
+        t.Error()
+    }
+    _, err=parse_dataset(strings.NewReader("user,a,password,false\n"), "csv")
+    if err==nil{
+        t.Error()
+    }
+    _, err=parse_dataset(strings.NewReader("version,1,2017-05-03T00:00:00Z\nbooking,a,2017,5,x,1\n"), "csv")
+    if err==nil{
+        t.Error()
+    }
+    _, err=parse_dataset(strings.NewReader("version,1,2017-05-03T00:00:00Z\n"), "xml")
+    if err==nil{
+        t.Error()
+    }
+}
+
+func TestUsersImport_dataset(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_user(Actor{}, "b", "secret")
+    users.add_entry(Actor{}, "a", Entry{2017,5,3,4})
+
+    dataset:=Dataset{
+        Version: dataset_version,
+        Settings: map[string]string{"min_year": "2000", "unknown": "1"},
+        Users: []Dataset_user{{"a", "password", false}, {"b", "changed", true}, {"c", "new", false}},
+        Bookings: []Booking{{"a", Entry{2017,5,3,4}}, {"c", Entry{2017,5,3,5}}},
+    }
+
+    report:=users.import_dataset(Actor{}, dataset, true)
+    if report.Applied || len(report.Conflicts)!=0 || len(report.Users_added)!=1 || len(report.Passwords_changed)!=1 || len(report.Users_disabled)!=1 || report.Users_unchanged!=1 || len(report.Bookings_added)!=1 || report.Bookings_unchanged!=1 || len(report.Settings_differing)!=2{
+        t.Error(report)
+    }
+    // A dry run changes nothing
+    if users.Len()!=2 || len(users.get_bookings())!=1{
+        t.Error()
+    }
+
+    report=users.import_dataset(Actor{}, dataset, false)
+    if !report.Applied || users.Len()!=3 || len(users.get_bookings())!=2{
+        t.Error(report)
+    }
+    password, err:=users.get_users_password("c")
+    if err!=nil || password!="new"{
+        t.Error()
+    }
+    if !users.get_user_list()[1].Disabled{
+        t.Error()
+    }
+
+    // Conflicts keep everything from being applied
+    dataset=Dataset{
+        Version: dataset_version,
+        Users: []Dataset_user{{"d", "new", false}, {"d", "again", false}, {"", "x", false}},
+        Bookings: []Booking{{"d", Entry{2017,5,3,4}}, {"d", Entry{2017,5,3,6}}, {"a", Entry{2017,5,3,6}}, {"x", Entry{2017,5,3,7}}, {"d", Entry{2017,13,3,7}}},
+    }
+    report=users.import_dataset(Actor{}, dataset, false)
+    if report.Applied || len(report.Conflicts)!=6 || users.Len()!=3 || len(users.get_bookings())!=2{
+        t.Error(report)
+    }
+}
+
+func TestUsersImport_datasetGuards(t *testing.T){
+    config:=default_config()
+    config.Min_password_length=4
+    config.Password_denylist_file=""
+    users:=new_users()
+    users.configure(config)
+    users.audit_log=nil
+    users.add_user(Actor{}, "admin", "admin password")
+    users.add_user(Actor{}, "a", "password")
+
+    // The admin cannot be disabled or get a new password, the rest is imported anyway
+    for _,admin:=range []Dataset_user{{"admin", "admin password", true}, {"admin", "new password", false}}{
+        report:=users.import_dataset(Actor{}, Dataset{Version: dataset_version, Users: []Dataset_user{admin}}, false)
+        if !report.Applied || len(report.Conflicts)!=0 || len(report.Users_skipped)!=1{
+            t.Error(report)
+        }
+    }
+    _, err:=users.get_users_password("admin")
+    if err!=nil{
+        t.Error(err)
+    }
+
+    // Passwords have to follow the policy
+    for _,user:=range []Dataset_user{{"a", "abc", false}, {"a", "password", true}, {"b", "abc", false}}{
+        report:=users.import_dataset(Actor{}, Dataset{Version: dataset_version, Users: []Dataset_user{user}}, false)
+        if (user.Password=="abc")!=(len(report.Conflicts)==1){
+            t.Error(user, report)
+        }
+    }
+    password, _:=users.get_users_password("admin")
+    if password!="admin password" || users.Len()!=2{
+        t.Error()
+    }
+}
+
+func TestUsersImport_datasetFresh_instance(t *testing.T){
+    old:=new_users()
+    old.add_user(Actor{}, "admin", "old admin password")
+    old.add_user(Actor{}, "a", "password")
+    old.add_entry(Actor{}, "a", Entry{2017,5,3,4})
+    old.add_entry(Actor{}, "admin", Entry{2017,5,3,5})
+
+    // A new instance only has an admin with a generated password
+    fresh:=new_users()
+    fresh.add_user(Actor{}, "admin", "generated password")
+
+    report:=fresh.import_dataset(Actor{}, old.export_dataset(), false)
+    if !report.Applied || len(report.Conflicts)!=0 || len(report.Users_added)!=1 || len(report.Users_skipped)!=1 || len(report.Bookings_added)!=2{
+        t.Error(report)
+    }
+    password, _:=fresh.get_users_password("admin")
+    if password!="generated password" || fresh.Len()!=2 || len(fresh.get_bookings())!=2{
+        t.Error()
+    }
+}
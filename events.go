@@ -0,0 +1,173 @@
+package main;
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
+
+// Number of changes a subscriber may fall behind before it gets disconnected
+const subscriber_buffer_size=64
+
+// How often a comment is sent to keep idle connections (and proxies) alive
+const heartbeat_interval=30*time.Second
+
+// A client interested in the entries of a single day
+type Subscriber struct{
+    day Entry
+    changes chan Change
+}
+
+// Fans out the changes made to the entries to every subscriber of the affected day
+type Event_hub struct{
+    users *Users
+    lock *sync.Mutex
+    subscribers map[*Subscriber]bool
+    // Set on shutdown, then subscribers are disconnected right away
+    closed bool
+}
+
+// Creates a hub and registers it as a listener of the users' changes
+func new_event_hub(users *Users) *Event_hub{
+    hub:=&Event_hub{users, &sync.Mutex{}, make(map[*Subscriber]bool), false}
+    users.add_listener(hub.publish)
+    return hub
+}
+
+// Day is an entry with slot 0
+func (h *Event_hub) subscribe(day Entry) *Subscriber{
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    subscriber:=&Subscriber{day, make(chan Change, subscriber_buffer_size)}
+    if h.closed{
+        close(subscriber.changes)
+        return subscriber
+    }
+    h.subscribers[subscriber]=true
+    return subscriber
+}
+
+// Disconnects every subscriber and every later one, so the server can shut down
+func (h *Event_hub) close(){
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    h.closed=true
+    for subscriber:=range h.subscribers{
+        delete(h.subscribers, subscriber)
+        close(subscriber.changes)
+    }
+}
+
+func (h *Event_hub) unsubscribe(subscriber *Subscriber){
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    if h.subscribers[subscriber]{
+        delete(h.subscribers, subscriber)
+        close(subscriber.changes)
+    }
+}
+
+// Is called with the users' lock held, so it never blocks: subscribers that cannot keep
+// up are dropped (their channel gets closed) and are expected to reconnect.
+func (h *Event_hub) publish(changes []Change){
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    for _,change:=range changes{
+        day:=change.Entry
+        day.Slot=0
+        for subscriber:=range h.subscribers{
+            if subscriber.day!=day{
+                continue
+            }
+
+            select{
+            case subscriber.changes<-change:
+            default:
+                delete(h.subscribers, subscriber)
+                close(subscriber.changes)
+            }
+        }
+    }
+}
+
+func (h *Event_hub) subscriber_count() int{
+    h.lock.Lock()
+    defer h.lock.Unlock()
+
+    return len(h.subscribers)
+}
+
+// Streams the entries of a day as server-sent events. Expects a GET request to
+// /events?days_in_the_future=<n>; an "entries" event (with the same data /get_entries
+// sends) is sent on connection and after every change to that day.
+func (h *Event_hub) http_events(w http.ResponseWriter, r *http.Request){
+    var to_send struct{
+        Date string `json:"date"`
+        Entries [24] string `json:"entries"`
+    }
+
+    if r.Method!="GET"{
+        http.Error(w, "Request to this address must be GET.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    flusher, ok:=w.(http.Flusher)
+    if !ok{
+        http.Error(w, "Streaming is not supported.", http.StatusInternalServerError)
+        return
+    }
+
+    days_in_the_future, err:=strconv.Atoi(r.URL.Query().Get("days_in_the_future"))
+    if err!=nil{
+        http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+        return
+    }
+
+    entry_day, date:=day_in_the_future(days_in_the_future)
+    to_send.Date=date
+
+    // Subscribe before reading the entries, so no change gets lost in between
+    subscriber:=h.subscribe(entry_day)
+    defer h.unsubscribe(subscriber)
+
+    send_entries:=func(){
+        entries:=h.users.get_entries_on_day(entry_day)
+        copy(to_send.Entries[:], entries[:])
+        data, _:=json.Marshal(&to_send)
+        fmt.Fprintf(w, "event: entries\ndata: %s\n\n", data)
+        flusher.Flush()
+    }
+
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    send_entries()
+
+    heartbeat:=time.NewTicker(heartbeat_interval)
+    defer heartbeat.Stop()
+    for{
+        select{
+        case _, ok:=<-subscriber.changes:
+            if !ok{
+                // Fell too far behind (or the server shuts down), the client will reconnect and
+                // get a fresh view
+                return
+            }
+            // Several changes may be pending, one view of the day covers them all
+            for len(subscriber.changes)>0{
+                <-subscriber.changes
+            }
+            send_entries()
+        case <-heartbeat.C:
+            fmt.Fprint(w, ": heartbeat\n\n")
+            flusher.Flush()
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
@@ -0,0 +1,75 @@
+package main;
+
+import "testing"
+
+func TestEvent_hubPublish(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+    hub:=new_event_hub(&users)
+
+    subscriber:=hub.subscribe(Entry{2017,2,3,0})
+    other_subscriber:=hub.subscribe(Entry{2017,2,4,0})
+
+    users.add_entry(Actor{}, "name", Entry{2017,2,3,4})
+    users.remove_entry(Actor{}, "name", Entry{2017,2,3,4})
+    users.add_entry(Actor{}, "name", Entry{2017,2,5,4})
+
+    if len(subscriber.changes)!=2 || len(other_subscriber.changes)!=0{
+        t.Error()
+        return
+    }
+
+    change:=<-subscriber.changes
+    if !change.Added || change.Name!="name" || !change.Entry.Equals(Entry{2017,2,3,4}){
+        t.Error()
+    }
+
+    change=<-subscriber.changes
+    if change.Added{
+        t.Error()
+    }
+
+    hub.unsubscribe(subscriber)
+    hub.unsubscribe(subscriber)
+    if hub.subscriber_count()!=1{
+        t.Error()
+    }
+}
+
+func TestEvent_hubSlow_subscriber(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+    hub:=new_event_hub(&users)
+
+    subscriber:=hub.subscribe(Entry{2017,2,3,0})
+    for i:=0; i<=subscriber_buffer_size; i++{
+        users.add_entry(Actor{}, "name", Entry{2017,2,3,i%24})
+        users.remove_entry(Actor{}, "name", Entry{2017,2,3,i%24})
+    }
+
+    // Publishing never blocks, the subscriber gets dropped instead
+    if hub.subscriber_count()!=0{
+        t.Error()
+    }
+
+    for range subscriber.changes{
+    }
+}
+
+func TestEvent_hubClose(t *testing.T){
+    users:=new_users()
+    hub:=new_event_hub(&users)
+
+    subscriber:=hub.subscribe(Entry{2017,2,3,0})
+    hub.close()
+    if _,ok:=<-subscriber.changes; ok || hub.subscriber_count()!=0{
+        t.Error()
+    }
+
+    // Later subscribers are disconnected right away
+    subscriber=hub.subscribe(Entry{2017,2,3,0})
+    if _,ok:=<-subscriber.changes; ok{
+        t.Error()
+    }
+    hub.unsubscribe(subscriber)
+}
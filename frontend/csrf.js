@@ -0,0 +1,15 @@
+// Adds the csrf token from the cookie to every form that is posted
+document.addEventListener("DOMContentLoaded", function(){
+    var match=document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+    if(!match){
+        return;
+    }
+    var forms=document.querySelectorAll("form");
+    for(var i=0; i<forms.length; i++){
+        var input=document.createElement("input");
+        input.type="hidden";
+        input.name="csrf_token";
+        input.value=decodeURIComponent(match[1]);
+        forms[i].appendChild(input);
+    }
+});
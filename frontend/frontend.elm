@@ -142,6 +142,7 @@ nav_bar =
         ,  ul [class "dropdown-menu"]
           [ li [] [a [href "/see_all"] [text "See All"]]
           , li [] [a [href "/remove_old"] [text "Remove Old Entries"]]
+          , li [] [a [href "/manage_users"] [text "Manage Users"]]
           ]
         ]
       ]
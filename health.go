@@ -0,0 +1,121 @@
+package main;
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "time"
+
+// How the data came to be when the server started
+const(
+    storage_loaded="loaded"
+    // There was no data file, this is a new installation
+    storage_created="created"
+)
+
+// How long the liveness check waits for the data's lock
+const liveness_timeout=5*time.Second
+
+// Jobs this late are considered stuck
+const job_overdue_after=time.Minute
+
+// Tells supervisors whether the server works
+type Health struct{
+    users *Users
+    scheduler *Scheduler
+    storage string
+    started time.Time
+}
+
+func new_health(users *Users, scheduler *Scheduler, storage string) *Health{
+    return &Health{users, scheduler, storage, time.Now()}
+}
+
+// Answers 200 as long as the server can get to its data, so a supervisor restarts it when
+// something holds the lock for good. Expects a GET request.
+func (h *Health) http_live(w http.ResponseWriter, r *http.Request){
+    if r.Method!="GET" && r.Method!="HEAD"{
+        http.Error(w, "Request to this address must be GET.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    locked:=make(chan struct{})
+    go func(){
+        h.users.get_revision()
+        close(locked)
+    }()
+
+    select{
+    case <-locked:
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        w.Write([]byte("ok"))
+    case <-time.After(liveness_timeout):
+        http.Error(w, "The data has been locked for too long", http.StatusServiceUnavailable)
+    }
+}
+
+// Describes the state of the data and the background jobs. Answers 503 when the server
+// should not get requests: while it shuts down and when the data cannot be saved.
+func (h *Health) http_ready(w http.ResponseWriter, r *http.Request){
+    var to_send struct{
+        Ready bool `json:"ready"`
+        // Why the server is not ready or what else is wrong
+        Problems []string `json:"problems"`
+        Started time.Time `json:"started"`
+        Storage struct{
+            Status string `json:"status"`
+            Users int `json:"users"`
+            Entries int `json:"entries"`
+            Last_saved *time.Time `json:"last_saved"`
+            Save_error string `json:"save_error,omitempty"`
+        } `json:"storage"`
+        Jobs []Job_status `json:"jobs"`
+    }
+
+    if r.Method!="GET" && r.Method!="HEAD"{
+        http.Error(w, "Request to this address must be GET.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    to_send.Ready=true
+    to_send.Problems=[]string{}
+    to_send.Started=h.started
+
+    to_send.Storage.Status=h.storage
+    to_send.Storage.Users=len(h.users.get_user_list())
+    to_send.Storage.Entries=len(h.users.get_bookings())
+    last_saved, save_error:=h.users.save_status()
+    if !last_saved.IsZero(){
+        to_send.Storage.Last_saved=&last_saved
+    }
+    if save_error!=nil{
+        to_send.Ready=false
+        to_send.Storage.Save_error=save_error.Error()
+        to_send.Problems=append(to_send.Problems, "The data could not be saved: "+save_error.Error())
+    }
+
+    select{
+    case <-h.users.stopping:
+        to_send.Ready=false
+        to_send.Problems=append(to_send.Problems, "The server is shutting down")
+    default:
+    }
+
+    // Failed jobs are reported, but the server can do without them for a while
+    now:=time.Now()
+    to_send.Jobs=h.scheduler.status()
+    for _,job:=range to_send.Jobs{
+        if job.Last_error!=""{
+            to_send.Problems=append(to_send.Problems, fmt.Sprintf("Job %s failed: %s", job.Name, job.Last_error))
+        }
+        if !job.Running && !job.Next_run.IsZero() && now.Sub(job.Next_run)>job_overdue_after{
+            to_send.Problems=append(to_send.Problems, fmt.Sprintf("Job %s is overdue", job.Name))
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "no-store")
+    if !to_send.Ready{
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(&to_send)
+}
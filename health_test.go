@@ -0,0 +1,74 @@
+package main;
+
+import "encoding/json"
+import "errors"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+func TestHealthHttp_live(t *testing.T){
+    users:=new_users()
+    health:=new_health(&users, new_scheduler(), storage_loaded)
+
+    w:=httptest.NewRecorder()
+    health.http_live(w, httptest.NewRequest("GET", "/healthz", nil))
+    if w.Code!=http.StatusOK{
+        t.Error()
+    }
+}
+
+func TestHealthHttp_ready(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,4})
+    scheduler:=new_scheduler()
+    scheduler.add("failing", func(now time.Time) time.Time{return now.Add(time.Millisecond)}, func() error{
+        return errors.New("Something went wrong")
+    })
+    health:=new_health(&users, scheduler, storage_created)
+
+    get:=func() (int, map[string]interface{}){
+        w:=httptest.NewRecorder()
+        health.http_ready(w, httptest.NewRequest("GET", "/readyz", nil))
+        var status map[string]interface{}
+        json.NewDecoder(w.Body).Decode(&status)
+        return w.Code, status
+    }
+
+    code, status:=get()
+    storage:=status["storage"].(map[string]interface{})
+    if code!=http.StatusOK || status["ready"]!=true || storage["status"]!="created" || storage["users"]!=1.0 || storage["entries"]!=1.0 || storage["last_saved"]!=nil{
+        t.Error(code, status)
+    }
+
+    // Failed jobs are problems, but the server is still ready
+    scheduler.start()
+    time.Sleep(50*time.Millisecond)
+    scheduler.stop()
+    code, status=get()
+    problems:=status["problems"].([]interface{})
+    if code!=http.StatusOK || len(problems)==0 || !strings.Contains(problems[0].(string), "failing"){
+        t.Error(code, status)
+    }
+
+    // Not when the data cannot be saved
+    users.to_file("DELETEME/missing/users.json")
+    code, status=get()
+    if code!=http.StatusServiceUnavailable || status["ready"]!=false{
+        t.Error(code, status)
+    }
+    _, err:=users.save_status()
+    if err==nil{
+        t.Error()
+    }
+
+    // Nor while shutting down
+    users.save_error=nil
+    users.stop_waiting()
+    code, _=get()
+    if code!=http.StatusServiceUnavailable{
+        t.Error(code)
+    }
+}
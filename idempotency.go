@@ -0,0 +1,194 @@
+package main;
+
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// A response to a mutating request, kept to be sent again if the request is retried
+type Idempotency_record struct{
+    Key string
+    Path string
+    // Keyed hash of the request's body, a retry must send the same data. The bodies
+    // contain passwords, so a plain hash could be cracked by whoever gets the file.
+    Fingerprint []byte `json:"Mac"`
+    Status int
+    Content_type string
+    Body []byte
+    Time time.Time
+}
+
+// Remembers the responses to the last requests that came with an Idempotency-Key header.
+// The records are kept in a file, so retries are recognized even after a restart.
+type Idempotency_cache struct{
+    filename string
+    // Key of the fingerprints
+    secret []byte
+    capacity int
+    max_age time.Duration
+    lock *sync.Mutex
+    // Oldest first
+    records []Idempotency_record
+    // Keys of requests that are still being handled
+    in_flight map[string]bool
+}
+
+// Loads the records from a file, a missing file means there are none yet. The secret file
+// is created if it does not exist.
+func new_idempotency_cache(filename, secret_filename string, capacity int, max_age time.Duration) (*Idempotency_cache, error){
+    if capacity<1{
+        return nil, errors.New("Idempotency cache's capacity must be positive")
+    }
+
+    secret, err:=load_secret(secret_filename)
+    if err!=nil{
+        return nil, err
+    }
+
+    loaded:=[]Idempotency_record{}
+    content, err:=ioutil.ReadFile(filename)
+    if err==nil{
+        err=json.Unmarshal(content, &loaded)
+        if err!=nil{
+            return nil, err
+        }
+    } else if !os.IsNotExist(err){
+        return nil, err
+    }
+    // Records from before the fingerprints were keyed have none, they are dropped
+    records:=[]Idempotency_record{}
+    for _,record:=range loaded{
+        if len(record.Fingerprint)>0{
+            records=append(records, record)
+        }
+    }
+
+    return &Idempotency_cache{filename, secret, capacity, max_age, &sync.Mutex{}, records, make(map[string]bool)}, nil
+}
+
+// Must be called with the lock held
+func (c *Idempotency_cache) find(key string) (Idempotency_record, bool){
+    for _,record:=range c.records{
+        if record.Key==key{
+            return record, true
+        }
+    }
+    return Idempotency_record{}, false
+}
+
+// Must be called with the lock held
+func (c *Idempotency_cache) store(record Idempotency_record) error{
+    // Drop expired records and make room for the new one
+    records:=[]Idempotency_record{}
+    for _,old_record:=range c.records{
+        if record.Time.Sub(old_record.Time)<=c.max_age{
+            records=append(records, old_record)
+        }
+    }
+    if len(records)>=c.capacity{
+        records=records[len(records)-c.capacity+1:]
+    }
+    c.records=append(records, record)
+
+    b, err:=json.Marshal(c.records)
+    if err!=nil{
+        return err
+    }
+    return ioutil.WriteFile(c.filename, b, 0600)
+}
+
+// Copies everything written to a response, so it can be stored
+type response_recorder struct{
+    http.ResponseWriter
+    status int
+    body bytes.Buffer
+}
+
+func (r *response_recorder) WriteHeader(status int){
+    r.status=status
+    r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *response_recorder) Write(b []byte) (int, error){
+    if r.status==0{
+        r.status=http.StatusOK
+    }
+    r.body.Write(b)
+    return r.ResponseWriter.Write(b)
+}
+
+// Wraps a handler, so that a POST request carrying an Idempotency-Key header that was
+// already answered gets the original answer again instead of being handled twice.
+func (c *Idempotency_cache) wrap(handler http.HandlerFunc) http.HandlerFunc{
+    return func(w http.ResponseWriter, r *http.Request){
+        client_key:=r.Header.Get("Idempotency-Key")
+        if r.Method!="POST" || client_key==""{
+            handler(w, r)
+            return
+        }
+
+        if len(client_key)>255{
+            http.Error(w, "Idempotency-Key is too long.", http.StatusBadRequest)
+            return
+        }
+
+        body, err:=ioutil.ReadAll(r.Body)
+        if err!=nil{
+            http.Error(w, "Request's data could not be read.", http.StatusBadRequest)
+            return
+        }
+        r.Body=ioutil.NopCloser(bytes.NewReader(body))
+        mac:=hmac.New(sha256.New, c.secret)
+        mac.Write(body)
+        fingerprint:=mac.Sum(nil)
+        key:=r.URL.Path+" "+client_key
+
+        c.lock.Lock()
+        record, found:=c.find(key)
+        if found && time.Since(record.Time)<=c.max_age{
+            c.lock.Unlock()
+            if !hmac.Equal(record.Fingerprint, fingerprint){
+                http.Error(w, "Idempotency-Key was already used for a different request.", http.StatusUnprocessableEntity)
+                return
+            }
+            w.Header().Set("Content-Type", record.Content_type)
+            w.Header().Set("Idempotent-Replayed", "true")
+            w.WriteHeader(record.Status)
+            w.Write(record.Body)
+            return
+        }
+        if c.in_flight[key]{
+            c.lock.Unlock()
+            http.Error(w, "A request with this Idempotency-Key is still being processed.", http.StatusConflict)
+            return
+        }
+        c.in_flight[key]=true
+        c.lock.Unlock()
+
+        recorder:=&response_recorder{ResponseWriter: w}
+        handler(recorder, r)
+
+        c.lock.Lock()
+        defer c.lock.Unlock()
+        delete(c.in_flight, key)
+
+        // Server errors are not remembered, so the request may be retried, and neither
+        // are answers that ask to try again later (like blocked logins, see
+        // http_login_error and login_return_code)
+        if recorder.status==0 || recorder.status>=500 || recorder.status==http.StatusTooManyRequests || recorder.Header().Get("Retry-After")!=""{
+            return
+        }
+
+        err=c.store(Idempotency_record{key, r.URL.Path, fingerprint, recorder.status, recorder.Header().Get("Content-Type"), recorder.body.Bytes(), time.Now()})
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+        }
+    }
+}
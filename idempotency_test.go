@@ -0,0 +1,138 @@
+package main;
+
+import "bytes"
+import "crypto/sha256"
+import "testing"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "strings"
+import "time"
+
+func TestIdempotency_cacheWrap(t *testing.T){
+    cache, err:=new_idempotency_cache("DELETEME.json", "DELETEME.secret", 2, time.Hour)
+    if err!=nil{
+        t.Error(err)
+        return
+    }
+
+    calls:=0
+    handler:=cache.wrap(func(w http.ResponseWriter, r *http.Request){
+        calls++
+        body, _:=ioutil.ReadAll(r.Body)
+        w.Header().Set("Content-Type", "text/plain")
+        w.Write(body)
+        w.Write([]byte{byte('0'+calls)})
+    })
+
+    send:=func(key, body string) *httptest.ResponseRecorder{
+        r:=httptest.NewRequest("POST", "/add_entry", strings.NewReader(body))
+        if key!=""{
+            r.Header.Set("Idempotency-Key", key)
+        }
+        w:=httptest.NewRecorder()
+        handler(w, r)
+        return w
+    }
+
+    if send("a", "x").Body.String()!="x1"{
+        t.Error()
+    }
+
+    // A retry gets the same answer without calling the handler again
+    w:=send("a", "x")
+    if w.Body.String()!="x1" || w.Header().Get("Idempotent-Replayed")!="true" || calls!=1{
+        t.Error()
+    }
+
+    // Same key, other data
+    if send("a", "y").Code!=http.StatusUnprocessableEntity{
+        t.Error()
+    }
+
+    // No key, no caching
+    if send("", "x").Body.String()!="x2" || send("", "x").Body.String()!="x3"{
+        t.Error()
+    }
+
+    // The records survive a restart
+    other, err:=new_idempotency_cache("DELETEME.json", "DELETEME.secret", 2, time.Hour)
+    if err!=nil || len(other.records)!=1{
+        t.Error()
+        return
+    }
+    // The data cannot be guessed from the file without the secret
+    plain:=sha256.Sum256([]byte("x"))
+    if len(other.records[0].Fingerprint)==0 || bytes.Equal(other.records[0].Fingerprint, plain[:]){
+        t.Error()
+    }
+
+    // Only the newest records are kept
+    send("b", "x")
+    send("c", "x")
+    if len(cache.records)!=2 || send("a", "x").Body.String()!="x6"{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+    err=os.Remove("DELETEME.secret")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestIdempotency_cacheWrapBlocked(t *testing.T){
+    cache, err:=new_idempotency_cache("DELETEME.json", "DELETEME.secret", 10, time.Hour)
+    if err!=nil{
+        t.Fatal(err)
+    }
+
+    blocked:=true
+    calls:=0
+    handler:=cache.wrap(func(w http.ResponseWriter, r *http.Request){
+        calls++
+        if blocked{
+            http_login_error(w, &Login_blocked_error{time.Second, false})
+            return
+        }
+        w.Write([]byte("ok"))
+    })
+    json_handler:=cache.wrap(func(w http.ResponseWriter, r *http.Request){
+        calls++
+        if blocked{
+            w.Write([]byte{byte('0'+login_return_code(w, &Login_blocked_error{time.Second, false}))})
+            return
+        }
+        w.Write([]byte("20"))
+    })
+
+    send:=func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder{
+        r:=httptest.NewRequest("POST", path, strings.NewReader("x"))
+        r.Header.Set("Idempotency-Key", "a")
+        w:=httptest.NewRecorder()
+        handler(w, r)
+        return w
+    }
+
+    // Blocked attempts are tried again once the block is over
+    if send(handler, "/change_password").Code!=http.StatusTooManyRequests || send(json_handler, "/add_entry").Body.String()!="5"{
+        t.Error()
+    }
+    blocked=false
+    if send(handler, "/change_password").Body.String()!="ok" || send(json_handler, "/add_entry").Body.String()!="20" || calls!=4{
+        t.Error(calls)
+    }
+
+    err=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+    err=os.Remove("DELETEME.secret")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
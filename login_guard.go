@@ -0,0 +1,263 @@
+package main;
+
+import "errors"
+import "fmt"
+import "net"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
+
+// Returned by authenticate instead of checking the password while guessing is slowed down
+type Login_blocked_error struct{
+    Retry_after time.Duration
+    // Whether the user made too many requests, rather than failed attempts
+    Rate_limited bool
+}
+
+func (e *Login_blocked_error) Error() string{
+    if e.Rate_limited{
+        return fmt.Sprintf("Too many requests, try again in %s", e.Retry_after.Round(time.Second))
+    }
+    return fmt.Sprintf("Too many failed attempts, try again in %s", e.Retry_after.Round(time.Second))
+}
+
+var error_unknown_user=errors.New("User with that name does not exist")
+var error_wrong_password=errors.New("Wrong password")
+
+// Failed attempts of an account or an address
+type Login_failures struct{
+    count int
+    last time.Time
+    blocked_until time.Time
+}
+
+// Counts failed logins per account and per address. After a few free attempts every
+// failure doubles the time until the next attempt is allowed, up to a lockout.
+type Login_guard struct{
+    lock *sync.Mutex
+    accounts map[string]*Login_failures
+    addresses map[string]*Login_failures
+    free_attempts int
+    lockout_attempts int
+    address_lockout_attempts int
+    lockout time.Duration
+    now func() time.Time
+}
+
+// Above this many tracked accounts and addresses, those that are not blocked any more are forgotten
+const max_login_failure_entries=10000
+
+func new_login_guard(config Config) *Login_guard{
+    return &Login_guard{
+        lock: &sync.Mutex{},
+        accounts: make(map[string]*Login_failures),
+        addresses: make(map[string]*Login_failures),
+        free_attempts: config.Login_free_attempts,
+        lockout_attempts: config.Login_lockout_attempts,
+        address_lockout_attempts: config.Login_address_lockout_attempts,
+        lockout: time.Duration(config.Login_lockout_minutes)*time.Minute,
+        now: time.Now,
+    }
+}
+
+// How long the account or the address have to wait before the next attempt
+func (g *Login_guard) wait(name, address string) time.Duration{
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    now:=g.now()
+    wait:=time.Duration(0)
+    for _,failures:=range []*Login_failures{g.accounts[name], g.addresses[address]}{
+        if failures!=nil && failures.blocked_until.Sub(now)>wait{
+            wait=failures.blocked_until.Sub(now)
+        }
+    }
+    return wait
+}
+
+// How long the address has to wait before the next attempt
+func (g *Login_guard) address_wait(address string) time.Duration{
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    f:=g.addresses[address]
+    if f==nil || !f.blocked_until.After(g.now()){
+        return 0
+    }
+    return f.blocked_until.Sub(g.now())
+}
+
+// Counts a failure and blocks further attempts for a while, returns whether this
+// failure locked the account or the address out
+func (g *Login_guard) failed(name, address string) (bool, bool){
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    now:=g.now()
+    return g.count(g.accounts, name, g.lockout_attempts, now), g.count(g.addresses, address, g.address_lockout_attempts, now)
+}
+
+// Counts a failure of something only the address is known of (like a reset code),
+// returns whether this failure locked the address out
+func (g *Login_guard) address_failed(address string) bool{
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    return g.count(g.addresses, address, g.address_lockout_attempts, g.now())
+}
+
+// Must be called with the lock held
+func (g *Login_guard) count(failures map[string]*Login_failures, key string, lockout_attempts int, now time.Time) bool{
+    if len(g.accounts)+len(g.addresses)>max_login_failure_entries{
+        g.forget(now)
+    }
+
+    f:=failures[key]
+    if f==nil || now.Sub(f.last)>g.lockout{
+        f=&Login_failures{}
+        failures[key]=f
+    }
+    f.count++
+    f.last=now
+
+    if f.count==lockout_attempts{
+        f.blocked_until=now.Add(g.lockout)
+        return true
+    }
+    if f.count>g.free_attempts{
+        backoff:=time.Second<<uint(f.count-g.free_attempts-1)
+        if backoff>g.lockout || f.count-g.free_attempts>30{
+            backoff=g.lockout
+        }
+        f.blocked_until=now.Add(backoff)
+    }
+    return false
+}
+
+// A correct password clears the account's failures but not the address'
+func (g *Login_guard) succeeded(name string){
+    g.lock.Lock()
+    defer g.lock.Unlock()
+    delete(g.accounts, name)
+}
+
+// Lets an account (or an address) try again right away, returns whether it was blocked
+func (g *Login_guard) unlock(name_or_address string) bool{
+    g.lock.Lock()
+    defer g.lock.Unlock()
+
+    _, account:=g.accounts[name_or_address]
+    _, address:=g.addresses[name_or_address]
+    delete(g.accounts, name_or_address)
+    delete(g.addresses, name_or_address)
+    return account || address
+}
+
+// Must be called with the lock held
+func (g *Login_guard) forget(now time.Time){
+    for _,failures:=range []map[string]*Login_failures{g.accounts, g.addresses}{
+        for key,f:=range failures{
+            if now.Sub(f.last)>g.lockout && !f.blocked_until.After(now){
+                delete(failures, key)
+            }
+        }
+    }
+}
+
+// The address of the client, without the port
+func remote_host(r *http.Request) string{
+    host, _, err:=net.SplitHostPort(r.RemoteAddr)
+    if err!=nil{
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// Checks a user's password, counting failures. Returns error_unknown_user,
+// error_wrong_password or a *Login_blocked_error (without checking the password).
+func (u *Users) authenticate(r *http.Request, name, password string) error{
+    // Requests with an api key were checked already (see Api_keys.wrap)
+    if key:=api_key_from_request(r);key!=nil{
+        if !key.allows(name){
+            u.metrics.failed_login("api_key_scope")
+            return error_api_key_scope
+        }
+        // Disabled users stay locked out
+        _, err:=u.get_users_password(name)
+        if err!=nil{
+            u.metrics.failed_login("unknown_user")
+            return error_unknown_user
+        }
+        return nil
+    }
+
+    address:=remote_host(r)
+    wait:=u.login_guard.wait(name, address)
+    if wait<=0{
+        wait=u.rate_limiter.take(rate_auth, "address "+address, "user "+name)
+    }
+    if wait>0{
+        u.metrics.failed_login("blocked")
+        return &Login_blocked_error{wait, false}
+    }
+
+    password_, err:=u.get_users_password(name)
+    if err==nil && password_==password{
+        u.login_guard.succeeded(name)
+        // Now that it is known who makes the request, it counts for them too
+        if category, ok:=rate_category_from_request(r);ok{
+            wait=u.rate_limiter.take(category, "user "+name)
+            if wait>0{
+                return &Login_blocked_error{wait, true}
+            }
+        }
+        return nil
+    }
+
+    account_locked, address_locked:=u.login_guard.failed(name, address)
+    if account_locked{
+        fmt.Println("Account locked out:", name)
+        u.audit(r, name, "lockout_account", name, "", u.login_guard.lockout.String())
+    }
+    if address_locked{
+        fmt.Println("Address locked out:", address)
+        u.audit(r, name, "lockout_address", address, "", u.login_guard.lockout.String())
+    }
+
+    if err!=nil{
+        u.metrics.failed_login("unknown_user")
+        return error_unknown_user
+    }
+    u.metrics.failed_login("wrong_password")
+    return error_wrong_password
+}
+
+// Answers a failed authentication of a form request
+func http_login_error(w http.ResponseWriter, err error){
+    if blocked, ok:=err.(*Login_blocked_error);ok{
+        w.Header().Set("Retry-After", strconv.Itoa(int(blocked.Retry_after/time.Second)+1))
+        http.Error(w, err.Error(), http.StatusTooManyRequests)
+        return
+    }
+    if err==error_api_key_scope{
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+    http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// Return code of json requests whose attempt was not checked because of failed ones
+const return_code_blocked=5
+
+// The return code of json requests for a failed authentication
+func login_return_code(w http.ResponseWriter, err error) int{
+    if blocked, ok:=err.(*Login_blocked_error);ok{
+        w.Header().Set("Retry-After", strconv.Itoa(int(blocked.Retry_after/time.Second)+1))
+        return return_code_blocked
+    }
+    if err==error_unknown_user{
+        return 1
+    }
+    return 2
+}
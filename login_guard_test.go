@@ -0,0 +1,131 @@
+package main;
+
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+func TestLogin_guard(t *testing.T){
+    config:=default_config()
+    config.Login_free_attempts=2
+    config.Login_lockout_attempts=5
+    config.Login_address_lockout_attempts=7
+    config.Login_lockout_minutes=15
+    guard:=new_login_guard(config)
+    now:=time.Date(2017, 5, 3, 12, 0, 0, 0, time.UTC)
+    guard.now=func() time.Time{ return now }
+
+    // Free attempts
+    guard.failed("a", "1.2.3.4")
+    guard.failed("a", "1.2.3.4")
+    if guard.wait("a", "5.6.7.8")!=0{
+        t.Error()
+    }
+
+    // Then the wait doubles
+    guard.failed("a", "1.2.3.4")
+    if guard.wait("a", "5.6.7.8")!=time.Second || guard.wait("b", "1.2.3.4")!=time.Second{
+        t.Error(guard.wait("a", "5.6.7.8"))
+    }
+    now=now.Add(time.Second)
+    guard.failed("a", "1.2.3.4")
+    if guard.wait("a", "5.6.7.8")!=2*time.Second{
+        t.Error()
+    }
+
+    // Until the account is locked out
+    now=now.Add(2*time.Second)
+    account_locked, address_locked:=guard.failed("a", "1.2.3.4")
+    if !account_locked || address_locked || guard.wait("a", "5.6.7.8")!=15*time.Minute{
+        t.Error()
+    }
+
+    // Other accounts from the same address are only locked out after more failures
+    guard.failed("b", "1.2.3.4")
+    account_locked, address_locked=guard.failed("c", "1.2.3.4")
+    if account_locked || !address_locked || guard.wait("d", "1.2.3.4")!=15*time.Minute{
+        t.Error()
+    }
+
+    // Unlocking
+    if !guard.unlock("a") || guard.wait("a", "5.6.7.8")!=0 || guard.unlock("a"){
+        t.Error()
+    }
+    if !guard.unlock("1.2.3.4") || guard.wait("d", "1.2.3.4")!=0{
+        t.Error()
+    }
+
+    // Success clears the account, failures are forgotten after a lockout's time
+    guard.failed("e", "1.2.3.4")
+    guard.failed("e", "1.2.3.4")
+    guard.failed("e", "1.2.3.4")
+    guard.succeeded("e")
+    if guard.wait("e", "5.6.7.8")!=0{
+        t.Error()
+    }
+    now=now.Add(time.Hour)
+    guard.failed("f", "5.6.7.8")
+    guard.failed("f", "5.6.7.8")
+    guard.failed("f", "5.6.7.8")
+    now=now.Add(time.Hour)
+    guard.failed("f", "5.6.7.8")
+    if guard.wait("f", "9.9.9.9")!=0{
+        t.Error()
+    }
+}
+
+func TestUsersAuthenticate(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "admin", "password")
+    users.audit_log=new_audit_log("DELETEME.log")
+
+    post:=func(admin_password string) int{
+        r:=httptest.NewRequest("POST", "/audit_log", strings.NewReader(url.Values{"admin_password": {admin_password}}.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        w:=httptest.NewRecorder()
+        users.http_audit_log(w, r)
+        return w.Code
+    }
+
+    if post("password")!=200{
+        t.Error()
+    }
+    for i:=0; i<users.config.Login_free_attempts; i++{
+        if post("wrong")!=401{
+            t.Error()
+        }
+    }
+    if post("wrong")!=401 || post("password")!=429{
+        t.Error()
+    }
+
+    // Unknown users count as failures too
+    r:=httptest.NewRequest("POST", "/", nil)
+    users.login_guard.unlock("admin")
+    users.login_guard.unlock(remote_host(r))
+    if users.authenticate(r, "nobody", "x")!=error_unknown_user{
+        t.Error()
+    }
+
+    // Lockouts are audited
+    now:=time.Now()
+    users.login_guard.now=func() time.Time{ return now }
+    for i:=0; i<users.config.Login_lockout_attempts; i++{
+        // Waits as long as asked to
+        now=now.Add(users.login_guard.wait("admin", remote_host(r)))
+        if users.authenticate(r, "admin", "wrong")!=error_wrong_password{
+            t.Error()
+        }
+    }
+    records, _:=users.audit_log.query(Audit_filter{Action: "lockout_account"})
+    if len(records)!=1 || records[0].Target!="admin"{
+        t.Error(records)
+    }
+
+    err:=os.Remove("DELETEME.log")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
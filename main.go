@@ -1,58 +1,112 @@
 package main;
 
+import "crypto/tls"
 import "encoding/json"
 import "net/http"
 import "fmt"
 import "os"
+import "os/signal"
+import "path/filepath"
 import "time"
 import "strings"
+import "strconv"
+import "syscall"
 
-func add_file_to_mux(mux *http.ServeMux, filepath string, mimetype string){
-    mux.HandleFunc(fmt.Sprintf("/%s", filepath), func (w http.ResponseWriter, r *http.Request){
+func add_file_to_mux_at_path(mux *http.ServeMux, webpath string, file_path string, mimetype string){
+    mux.HandleFunc(webpath, func (w http.ResponseWriter, r *http.Request){
         w.Header().Set("Content-Type", mimetype)
-        http.ServeFile(w, r, filepath)
+        http.ServeFile(w, r, file_path)
     })
 }
 
-func add_file_to_mux_at_path(mux *http.ServeMux, webpath string, filepath string, mimetype string){
-    mux.HandleFunc(webpath, func (w http.ResponseWriter, r *http.Request){
-        w.Header().Set("Content-Type", mimetype)
-        http.ServeFile(w, r, filepath)
-    })
+// Returns the day that lies a number of days in the future (as an entry with slot 0) and its readable date
+func day_in_the_future(days_in_the_future int) (Entry, string){
+    now:=time.Now().AddDate(0,0,days_in_the_future)
+    year, month, day:=now.Date()
+    weekday:=now.Weekday()
+    return Entry{year, int(month), day, 0}, fmt.Sprintf("%s, %d of %s", weekday.String(), day, month.String())
 }
 
+// Longest time a request to /get_entries may wait for a change
+const max_revision_wait=30*time.Second
+
+// Accepts a POST with json data or a GET with the same fields as query parameters.
+// If wait_for_revision is given, the answer is delayed until the day's revision is
+// greater than it (or max_revision_wait passes), which allows for cheap long-polling.
 func (u *Users) http_get_entries(w http.ResponseWriter, r *http.Request){
     var to_get struct{
         Days_in_the_future int `json:"days_in_the_future"`
+        Wait_for_revision *uint64 `json:"wait_for_revision"`
     }
 
     var to_send struct{
         Date string `json:"date"`
         Entries [24] string `json:"entries"`
+        Revision uint64 `json:"revision"`
     }
 
-    if r.Method!="POST"{
-        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
-    }
-
-    err:=json.NewDecoder(r.Body).Decode(&to_get)
-    if err!=nil{
-        http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+    switch r.Method{
+    case "GET":
+        var err error
+        query:=r.URL.Query()
+        to_get.Days_in_the_future, err=strconv.Atoi(query.Get("days_in_the_future"))
+        if err!=nil{
+            http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+            return
+        }
+        if query.Get("wait_for_revision")!=""{
+            revision, err:=strconv.ParseUint(query.Get("wait_for_revision"), 10, 64)
+            if err!=nil{
+                http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+                return
+            }
+            to_get.Wait_for_revision=&revision
+        }
+    case "POST":
+        err:=json.NewDecoder(r.Body).Decode(&to_get)
+        if err!=nil{
+            http.Error(w, "Request's data could not be parsed.", http.StatusBadRequest)
+            return
+        }
+    default:
+        http.Error(w, "Request to this address must be GET or POST.", http.StatusMethodNotAllowed)
         return
     }
 
-    // Get entries for the specified day
-    now:=time.Now().AddDate(0,0,to_get.Days_in_the_future)
-    year, month, day:=now.Date()
-    weekday:=now.Weekday()
-    to_send.Date=fmt.Sprintf("%s, %d of %s", weekday.String(), day, month.String())
-    entries:=u.get_entries_on_day(Entry{year, int(month), day, 0})
+    // Get entries for the specified day, waiting for a change first if asked to
+    entry_day, date:=day_in_the_future(to_get.Days_in_the_future)
+    if to_get.Wait_for_revision!=nil{
+        u.wait_for_day_revision(entry_day, *to_get.Wait_for_revision, max_revision_wait)
+    }
+    entries, revision:=u.get_entries_on_day_with_revision(entry_day)
+    to_send.Date=date
+    to_send.Revision=revision
     copy(to_send.Entries[:], entries[:])
 
+    // The date is part of the data sent, so it is part of the tag too
+    etag:=fmt.Sprintf("\"%x-%d-%d-%d-%d\"", u.epoch, entry_day.Year, entry_day.Month, entry_day.Day, revision)
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "no-cache")
+    if etag_matches(r.Header.Get("If-None-Match"), etag){
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(&to_send)
 }
 
+// Checks whether an If-None-Match header value contains the given (strong) tag
+func etag_matches(if_none_match string, etag string) bool{
+    for _,candidate:=range strings.Split(if_none_match, ","){
+        candidate=strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+        if candidate==etag || candidate=="*"{
+            return true
+        }
+    }
+    return false
+}
+
 func (u *Users) http_add_entry(w http.ResponseWriter, r *http.Request){
     var to_get struct{
         Days_in_the_future int `json:"days_in_the_future"`
@@ -76,18 +130,10 @@ func (u *Users) http_add_entry(w http.ResponseWriter, r *http.Request){
         return
     }
 
-    // Get password, on error send error code
-    password, err:=u.get_users_password(to_get.Name)
+    // See if the user exists and the password is correct, on error send error code
+    err=u.authenticate(r, to_get.Name, to_get.Password)
     if err!=nil{
-        to_send.Return_code=1
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(&to_send)
-        return
-    }
-
-    // See if password is correct, on error send error code
-    if to_get.Password!=password{
-        to_send.Return_code=2
+        to_send.Return_code=login_return_code(w, err)
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(&to_send)
         return
@@ -106,7 +152,7 @@ func (u *Users) http_add_entry(w http.ResponseWriter, r *http.Request){
 
     // Try to add the actual entry
     new_entry:=Entry{year, int(month), day, to_get.Active_entry}
-    err=u.add_entry(to_get.Name, new_entry)
+    err=u.add_entry(Actor{to_get.Name, r}, to_get.Name, new_entry)
     if err!=nil{
         to_send.Return_code=4
         w.Header().Set("Content-Type", "application/json")
@@ -115,7 +161,7 @@ func (u *Users) http_add_entry(w http.ResponseWriter, r *http.Request){
     }
 
     // Save changes to file
-    err=u.to_file("users.json")
+    err=u.to_file(u.config.Data_file)
     if err!=nil{
         fmt.Fprintln(os.Stderr, err)
     }
@@ -151,18 +197,10 @@ func (u *Users) http_remove_entry(w http.ResponseWriter, r *http.Request){
         return
     }
 
-    // Get password, on error send error code
-    password, err:=u.get_users_password(to_get.Name)
+    // See if the user exists and the password is correct, on error send error code
+    err=u.authenticate(r, to_get.Name, to_get.Password)
     if err!=nil{
-        to_send.Return_code=1
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(&to_send)
-        return
-    }
-
-    // See if password is correct, on error send error code
-    if to_get.Password!=password{
-        to_send.Return_code=2
+        to_send.Return_code=login_return_code(w, err)
         w.Header().Set("Content-Type", "application/json")
         json.NewEncoder(w).Encode(&to_send)
         return
@@ -181,7 +219,7 @@ func (u *Users) http_remove_entry(w http.ResponseWriter, r *http.Request){
 
     // Try to remove the actual entry
     entry_to_remove:=Entry{year, int(month), day, to_get.Active_entry}
-    err=u.remove_entry(to_get.Name, entry_to_remove)
+    err=u.remove_entry(Actor{to_get.Name, r}, to_get.Name, entry_to_remove)
     if err!=nil{
         to_send.Return_code=4
         w.Header().Set("Content-Type", "application/json")
@@ -190,7 +228,7 @@ func (u *Users) http_remove_entry(w http.ResponseWriter, r *http.Request){
     }
 
     // Save changes to file
-    err=u.to_file("users.json")
+    err=u.to_file(u.config.Data_file)
     if err!=nil{
         fmt.Fprintln(os.Stderr, err)
     }
@@ -206,7 +244,7 @@ func (u *Users) http_remove_entry(w http.ResponseWriter, r *http.Request){
 func (u *Users) http_change_password(w http.ResponseWriter, r *http.Request){
     if r.Method=="GET"{
         w.Header().Set("Content-Type", "text/html")
-        http.ServeFile(w, r, "frontend/change_password.html")
+        http.ServeFile(w, r, filepath.Join(u.config.Frontend_dir, "change_password.html"))
         return
     }
 
@@ -219,9 +257,6 @@ func (u *Users) http_change_password(w http.ResponseWriter, r *http.Request){
     password:=r.FormValue("password")
     new_password1:=r.FormValue("new_password1")
     new_password2:=r.FormValue("new_password2")
-    character_whitelist:="abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-    min_password_length:=4
-    max_password_length:=32
 
     // If the new password and the new password re-entry are inconsistent
     if new_password1!=new_password2{
@@ -229,37 +264,21 @@ func (u *Users) http_change_password(w http.ResponseWriter, r *http.Request){
         return
     }
 
-    // If the new password's length is not within bounds
-    if len(new_password1)<min_password_length || len(new_password1)>max_password_length{
-        http.Error(w, fmt.Sprintf("New password's length must be between %d and %d", min_password_length, max_password_length), http.StatusBadRequest)
-        return
-    }
-
-    // Chech wheter only whitelisted characters are contained in the new password
-    password_has_whitelisted_chars_only:=func() bool{
-        for _,password_char:=range new_password1{
-            if !strings.ContainsAny(string(password_char), character_whitelist){
-                return false
-            }
-        }
-        return true
-    }()
-
-    // If there are non-whitelisted characters in the new password
-    if !password_has_whitelisted_chars_only{
-        http.Error(w, fmt.Sprintf("New password may only have allowed characters (%s)", character_whitelist), http.StatusBadRequest)
+    err:=u.authenticate(r, name, password)
+    if err!=nil{
+        http_login_error(w, err)
         return
     }
 
     // Do the actual password change
-    err:=u.change_password(name, password, new_password1)
+    err=u.change_password(Actor{name, r}, name, password, new_password1)
     if err!=nil{
         http.Error(w, err.Error(), http.StatusBadRequest)
         return
     }
 
     // Save changes to file
-    err=u.to_file("users.json")
+    err=u.to_file(u.config.Data_file)
     if err!=nil{
         fmt.Fprintln(os.Stderr, err)
     }
@@ -270,10 +289,10 @@ func (u *Users) http_change_password(w http.ResponseWriter, r *http.Request){
     return
 }
 
-func (u *Users) http_see_all(w http.ResponseWriter, r *http.Request){
+func (u *Users) http_remove_old(w http.ResponseWriter, r *http.Request){
     if r.Method=="GET"{
         w.Header().Set("Content-Type", "text/html")
-        http.ServeFile(w, r, "frontend/admin.html")
+        http.ServeFile(w, r, filepath.Join(u.config.Frontend_dir, "admin.html"))
         return
     }
 
@@ -283,110 +302,271 @@ func (u *Users) http_see_all(w http.ResponseWriter, r *http.Request){
 
     // Get form data
     admin_password:=r.FormValue("admin_password")
-    admin_password_, err:=u.get_users_password("admin")
+    err:=u.authenticate(r, "admin", admin_password)
     if err!=nil{
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
-    }
-
-    // If the enetered password is not the admin's
-    if admin_password_!=admin_password{
-        http.Error(w, "Wrong password", http.StatusUnauthorized)
+        http_login_error(w, err)
         return
     }
 
-    // Get all data (including all passwords) in readable json format
-    json_users,err:=u.as_json()
+    // Old entries are kept in the archive
+    today, _:=day_in_the_future(0)
+    _, err=u.archive_entries_before(Actor{"admin", r}, today, u.archive)
     if err!=nil{
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
-
-    w.Header().Set("Content-Type", "application/json")
-    w.Write(json_users)
+    // Save changes to file
+    err=u.to_file(u.config.Data_file)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+    }
+    fmt.Println("Old entries archived")
+    w.Header().Set("Content-Type", "text/html")
+    w.Write([]byte("Old entries archived"))
     return
 }
 
-func (u *Users) http_remove_old(w http.ResponseWriter, r *http.Request){
-    if r.Method=="GET"{
-        w.Header().Set("Content-Type", "text/html")
-        http.ServeFile(w, r, "frontend/admin.html")
-        return
-    }
 
-    if r.Method!="POST"{
-        http.Error(w, "Request to this address must be GET or POST.", http.StatusMethodNotAllowed)
-    }
+func main() {
+    os.Exit(run_cli(os.Args[1:]))
+}
 
-    // Get form data
-    admin_password:=r.FormValue("admin_password")
-    admin_password_, err:=u.get_users_password("admin")
+// Runs the server, returns the exit status
+func serve(config Config) int{
+    // Keeps the command line tools from changing the data while the server runs
+    unlock, err:=lock_data_file(config.Data_file)
     if err!=nil{
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+        fmt.Fprintln(os.Stderr, err)
+        return 1
     }
+    defer unlock()
 
-    if admin_password_!=admin_password{
-        http.Error(w, "Wrong password", http.StatusUnauthorized)
-        return
+    // Starting with data that cannot be used would only lose it
+    storage:=storage_loaded
+    users, err:=load_users(config)
+    if os.IsNotExist(err){
+        fmt.Println("There is no data file", config.Data_file, "yet, starting without users")
+        storage=storage_created
+        users=new_users()
+        users.configure(config)
+        err=nil
     }
-
-    u.remove_old_entries()
-    // Save changes to file
-    err=u.to_file("users.json")
     if err!=nil{
-        fmt.Fprintln(os.Stderr, err)
+        fmt.Fprintln(os.Stderr, "Could not load the data file:", err)
+        return 1
+    }
+    // Checked before anything is saved, a missing admin is created below
+    users.Sort()
+    problems:=[]string{}
+    for _,problem:=range users.check(){
+        if problem!=problem_no_admin{
+            problems=append(problems, problem)
+        }
+    }
+    if len(problems)>0{
+        for _,problem:=range problems{
+            fmt.Fprintln(os.Stderr, problem)
+        }
+        fmt.Fprintln(os.Stderr, "The data file is inconsistent, fix it before starting the server (see \"kathrin db check\")")
+        return 1
     }
-    fmt.Println("Old entries removed")
-    w.Header().Set("Content-Type", "text/html")
-    w.Write([]byte("Old entries removed"))
-    return
-}
 
+    metrics:=new_metrics()
+    users.set_metrics(metrics)
 
-func main() {
-    // users:=new_users()
-    // rooms:=[]string{
-    //     "101","102","103","104","105","106","107","108","109","110",
-    //     "201","202","203","204","205","206","207","208","209","210",
-    //     "301","302","303","304","305","306","307","308","309","310",
-    //     "401","402","403","404","405","406","407","408","409","410",
-    //     "501","502","503","504","505","506","507","508","509","510",
-    // }
-
-    // for _,room:=range rooms{
-    //     users.add_user(room, "password")
-    // }
-
-    // fmt.Println(users.users)
-    // users.to_file("users.json")
-    // return
-
-    users, err:=from_file("users.json")
+    // A new installation gets an admin with a generated password
+    _, err=users.get_users_entries("admin")
     if err!=nil{
-        fmt.Fprintln(os.Stderr, err)
+        password, err:=config.generate_password()
+        if err==nil{
+            err=users.add_user(Actor{"server", nil}, "admin", password)
+        }
+        if err==nil{
+            err=users.to_file(config.Data_file)
+        }
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, "Could not create the admin user:", err)
+            return 1
+        }
+        fmt.Println("Created the user admin with the password", password)
+    }
+
+    // Without the denylist every new password is refused, better to know right away
+    _, err=users.password_policy.load_denylist()
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Password denylist:", err)
     }
-    users.add_user("admin", "password")
-    users.Sort()
 
 
     mux:=http.NewServeMux()
-    add_file_to_mux_at_path(mux, "/", "frontend/index.html", "text/html")
-    add_file_to_mux(mux, "bootstrap/css/bootstrap.min.css", "text/css")
-    add_file_to_mux(mux, "bootstrap/js/bootstrap.min.js", "application/javascript")
-    add_file_to_mux(mux, "bootstrap/js/jquery.min.js", "application/javascript")
-    add_file_to_mux(mux, "bootstrap/fonts/glyphicons-halflings-regular.ttf", "text/plain")
-    add_file_to_mux(mux, "bootstrap/fonts/glyphicons-halflings-regular.woff", "text/plain")
-    add_file_to_mux(mux, "bootstrap/fonts/glyphicons-halflings-regular.woff2", "text/plain")
+    add_file_to_mux_at_path(mux, "/", filepath.Join(config.Frontend_dir, "index.html"), "text/html")
+    add_file_to_mux_at_path(mux, "/csrf.js", filepath.Join(config.Frontend_dir, "csrf.js"), "application/javascript")
+    bootstrap_files:=[][2]string{
+        {"css/bootstrap.min.css", "text/css"},
+        {"js/bootstrap.min.js", "application/javascript"},
+        {"js/jquery.min.js", "application/javascript"},
+        {"fonts/glyphicons-halflings-regular.ttf", "text/plain"},
+        {"fonts/glyphicons-halflings-regular.woff", "text/plain"},
+        {"fonts/glyphicons-halflings-regular.woff2", "text/plain"},
+    }
+    for _,file:=range bootstrap_files{
+        add_file_to_mux_at_path(mux, "/bootstrap/"+file[0], filepath.Join(config.Bootstrap_dir, filepath.FromSlash(file[0])), file[1])
+    }
     mux.HandleFunc("/get_entries", users.http_get_entries)
-    mux.HandleFunc("/add_entry", users.http_add_entry)
-    mux.HandleFunc("/remove_entry", users.http_remove_entry)
-    mux.HandleFunc("/change_password", users.http_change_password)
     mux.HandleFunc("/see_all", users.http_see_all)
-    mux.HandleFunc("/remove_old", users.http_remove_old)
+    mux.HandleFunc("/export_raw", users.http_export_raw)
+    mux.HandleFunc("/export_data", users.http_export_data)
+
+    // Mutating requests may be retried safely by sending an Idempotency-Key header
+    idempotent:=func(handler http.HandlerFunc) http.HandlerFunc{
+        return handler
+    }
+    idempotency_cache, err:=new_idempotency_cache(config.Idempotency_file, config.Idempotency_secret_file, 1000, 24*time.Hour)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Idempotency keys disabled:", err)
+    } else{
+        idempotent=idempotency_cache.wrap
+    }
+    mux.HandleFunc("/add_entry", idempotent(users.http_add_entry))
+    mux.HandleFunc("/remove_entry", idempotent(users.http_remove_entry))
+    mux.HandleFunc("/change_password", idempotent(users.http_change_password))
+    mux.HandleFunc("/remove_old", idempotent(users.http_remove_old))
+    mux.HandleFunc("/batch", idempotent(users.http_batch))
+    mux.HandleFunc("/manage_users", idempotent(users.http_manage_users))
+    // Not idempotent, the cache would keep the generated passwords
+    mux.HandleFunc("/provision_users", users.http_provision_users)
+    mux.HandleFunc("/import_data", idempotent(users.http_import_data))
+    mux.HandleFunc("/audit_log", users.http_audit_log)
+    mux.HandleFunc("/statistics", users.http_statistics)
+    mux.HandleFunc("/archive", users.http_archive)
+
+    reset_codes, err:=new_reset_codes(&users, config.Reset_code_file, time.Duration(config.Reset_code_hours)*time.Hour)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Password reset codes disabled:", err)
+    } else{
+        mux.HandleFunc("/issue_reset_code", reset_codes.http_issue_reset_code)
+        mux.HandleFunc("/redeem_reset_code", idempotent(reset_codes.http_redeem_reset_code))
+    }
+
+    api_keys, err:=new_api_keys(&users, config.Api_key_file, config.Api_key_rate_per_minute)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Api keys disabled:", err)
+    } else{
+        // Not idempotent, the cache would keep issued keys
+        mux.HandleFunc("/api_keys", api_keys.http_api_keys)
+    }
 
+    hub:=new_event_hub(&users)
+    mux.HandleFunc("/events", hub.http_events)
 
-    if err:=http.ListenAndServe(":8000", mux);err!=nil{
+    calendar, err:=new_calendar(&users, config.Calendar_secret_file)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, "Calendar feeds disabled:", err)
+    } else{
+        mux.HandleFunc("/calendar/", calendar.http_calendar)
+        mux.HandleFunc("/calendar_token", calendar.http_calendar_token)
+    }
+
+    // Old entries are moved to the archive in the background
+    scheduler:=new_scheduler()
+    cleanup_schedule, _:=parse_schedule(config.Cleanup_schedule)
+    if cleanup_schedule!=nil{
+        scheduler.add("cleanup", cleanup_schedule, func() error{
+            err:=users.run_retention()
+            if err!=nil{
+                fmt.Fprintln(os.Stderr, "Could not archive old entries:", err)
+            }
+            return err
+        })
+    }
+    scheduler.start()
+    defer scheduler.stop()
+
+    // For supervisors and load balancers
+    health:=new_health(&users, scheduler, storage)
+    mux.HandleFunc("/healthz", health.http_live)
+    mux.HandleFunc("/readyz", health.http_ready)
+    mux.HandleFunc("/metrics", metrics.http_metrics)
+
+    // Clients that send too many requests have to wait
+    var handler http.Handler=users.rate_limiter.wrap(mux, mux)
+    if api_keys!=nil{
+        handler=api_keys.wrap(handler)
+    }
+    // Other sites may not make browsers post here
+    csrf_guard:=new_csrf_guard(config.Trusted_origins)
+    server:=&http.Server{Addr: config.Address, Handler: metrics.wrap(mux, csrf_guard.wrap(handler))}
+    // Long polls and event streams would keep the server from shutting down
+    server.RegisterOnShutdown(users.stop_waiting)
+    server.RegisterOnShutdown(hub.close)
+    servers:=[]*http.Server{server}
+    listen:=server.ListenAndServe
+
+    if config.Tls_cert_file!=""{
+        var certificates *Certificate_loader
+        certificates, err=new_certificate_loader(config.Tls_cert_file, config.Tls_key_file)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, "Could not load certificate:", err)
+            return 1
+        }
+        stop_watching:=make(chan struct{})
+        defer close(stop_watching)
+        go certificates.watch(certificate_check_interval, stop_watching)
+        server.TLSConfig=&tls.Config{GetCertificate: certificates.get_certificate, MinVersion: tls.VersionTLS12}
+        server.Handler=hsts(config.Hsts_max_age, server.Handler)
+        listen=func() error{
+            return server.ListenAndServeTLS("", "")
+        }
+
+        if config.Redirect_address!=""{
+            servers=append(servers, &http.Server{Addr: config.Redirect_address, Handler: https_redirect(config.Address)})
+            fmt.Println("Redirecting http on", config.Redirect_address)
+        }
+    }
+
+    server_errors:=make(chan error, len(servers))
+    go func(){
+        server_errors<-listen()
+    }()
+    for _,redirect_server:=range servers[1:]{
+        go func(redirect_server *http.Server){
+            server_errors<-redirect_server.ListenAndServe()
+        }(redirect_server)
+    }
+    fmt.Println("Listening on", config.Address)
+
+    // Runs until a server fails or the process is asked to stop
+    signals:=make(chan os.Signal, 1)
+    signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+    status:=0
+    select{
+    case err=<-server_errors:
         fmt.Fprintln(os.Stderr, err)
+        status=1
+    case received:=<-signals:
+        fmt.Println("Received", received, "- shutting down")
+    }
+    // A second signal ends the process right away (the data file is still either the old
+    // or the new one then)
+    signal.Stop(signals)
+
+    // What a failed save or the api keys' last uses left unsaved
+    flushes:=[]func() error{
+        func() error{
+            return users.to_file(config.Data_file)
+        },
+    }
+    if api_keys!=nil{
+        flushes=append(flushes, api_keys.flush)
+    }
+    err=shut_down(shutdown_timeout, servers, scheduler, flushes)
+    if err!=nil{
+        status=1
+    }
+    if status==0{
+        fmt.Println("Shut down cleanly")
+    } else{
+        fmt.Fprintln(os.Stderr, "Shut down after errors")
     }
+    return status
 }
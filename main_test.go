@@ -0,0 +1,60 @@
+package main;
+
+import "net/http"
+import "net/http/httptest"
+import "testing"
+
+func TestEtag_matches(t *testing.T){
+    etag:=`"1-2017-2-3-4"`
+    if !etag_matches(etag, etag) || !etag_matches(`"other", W/`+etag, etag) || !etag_matches("*", etag){
+        t.Error()
+    }
+    if etag_matches("", etag) || etag_matches(`"1-2017-2-3-5"`, etag) || etag_matches(`"other"`, etag){
+        t.Error()
+    }
+}
+
+func TestUsersHttp_get_entriesEtag(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+
+    get:=func(if_none_match string) *httptest.ResponseRecorder{
+        r:=httptest.NewRequest("GET", "/get_entries?days_in_the_future=0", nil)
+        if if_none_match!=""{
+            r.Header.Set("If-None-Match", if_none_match)
+        }
+        w:=httptest.NewRecorder()
+        users.http_get_entries(w, r)
+        return w
+    }
+
+    w:=get("")
+    etag:=w.Header().Get("ETag")
+    if w.Code!=http.StatusOK || etag=="" || w.Body.Len()==0{
+        t.Error()
+    }
+
+    // The same tag or any tag means nothing changed
+    w=get(etag)
+    if w.Code!=http.StatusNotModified || w.Body.Len()!=0 || w.Header().Get("ETag")!=etag{
+        t.Error(w.Code)
+    }
+    if get("*").Code!=http.StatusNotModified{
+        t.Error()
+    }
+    if get(`"something else"`).Code!=http.StatusOK{
+        t.Error()
+    }
+
+    // A change to the day makes the old tag stale
+    day, _:=day_in_the_future(0)
+    day.Slot=5
+    users.add_entry(Actor{}, "a", day)
+    w=get(etag)
+    if w.Code!=http.StatusOK || w.Header().Get("ETag")==etag{
+        t.Error(w.Code)
+    }
+    if get(w.Header().Get("ETag")).Code!=http.StatusNotModified{
+        t.Error()
+    }
+}
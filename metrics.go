@@ -0,0 +1,360 @@
+package main;
+
+import "bytes"
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Upper bounds of the histograms' buckets, in seconds
+var request_duration_buckets=[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+var save_duration_buckets=[]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+var lock_wait_buckets=[]float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 1}
+
+// Escapes a label value for the Prometheus text format
+func escape_label_value(value string) string{
+    value=strings.Replace(value, `\`, `\\`, -1)
+    value=strings.Replace(value, `"`, `\"`, -1)
+    value=strings.Replace(value, "\n", `\n`, -1)
+    return value
+}
+
+// Renders labels like {handler="/add_entry",code="200"}, nothing if there are none
+func format_labels(names []string, values []string) string{
+    if len(names)==0{
+        return ""
+    }
+    labels:=[]string{}
+    for i,name:=range names{
+        labels=append(labels, name+`="`+escape_label_value(values[i])+`"`)
+    }
+    return "{"+strings.Join(labels, ",")+"}"
+}
+
+func format_metric_value(value float64) string{
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Sorted keys, so the output does not change order between scrapes
+func sorted_keys(values interface{}) []string{
+    keys:=[]string{}
+    switch values:=values.(type){
+    case map[string]float64:
+        for key:=range values{
+            keys=append(keys, key)
+        }
+    case map[string]*Histogram_series:
+        for key:=range values{
+            keys=append(keys, key)
+        }
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// A counter or gauge for every combination of label values. The owner has to lock it.
+type Value_vec struct{
+    name string
+    help string
+    kind string
+    label_names []string
+    // By the labels formatted as in the output
+    values map[string]float64
+}
+
+func new_value_vec(name, help, kind string, label_names ...string) *Value_vec{
+    vec:=&Value_vec{name, help, kind, label_names, make(map[string]float64)}
+    if len(label_names)==0{
+        vec.values[""]=0
+    }
+    return vec
+}
+
+func (v *Value_vec) add(value float64, label_values ...string){
+    v.values[format_labels(v.label_names, label_values)]+=value
+}
+
+func (v *Value_vec) set(value float64, label_values ...string){
+    v.values[format_labels(v.label_names, label_values)]=value
+}
+
+func (v *Value_vec) write(w io.Writer){
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+    for _,labels:=range sorted_keys(v.values){
+        fmt.Fprintf(w, "%s%s %s\n", v.name, labels, format_metric_value(v.values[labels]))
+    }
+}
+
+type Histogram_series struct{
+    label_values []string
+    // Observations in each bucket, not cumulative
+    counts []uint64
+    sum float64
+    count uint64
+}
+
+// A histogram for every combination of label values. The owner has to lock it.
+type Histogram_vec struct{
+    name string
+    help string
+    buckets []float64
+    label_names []string
+    series map[string]*Histogram_series
+}
+
+func new_histogram_vec(name, help string, buckets []float64, label_names ...string) *Histogram_vec{
+    return &Histogram_vec{name, help, buckets, label_names, make(map[string]*Histogram_series)}
+}
+
+func (h *Histogram_vec) observe(value float64, label_values ...string){
+    key:=format_labels(h.label_names, label_values)
+    series:=h.series[key]
+    if series==nil{
+        series=&Histogram_series{label_values, make([]uint64, len(h.buckets)), 0, 0}
+        h.series[key]=series
+    }
+
+    for i,bound:=range h.buckets{
+        if value<=bound{
+            series.counts[i]++
+            break
+        }
+    }
+    series.sum+=value
+    series.count++
+}
+
+func (h *Histogram_vec) write(w io.Writer){
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+    bucket_label_names:=append(append([]string{}, h.label_names...), "le")
+    for _,key:=range sorted_keys(h.series){
+        series:=h.series[key]
+        cumulative:=uint64(0)
+        for i,bound:=range h.buckets{
+            cumulative+=series.counts[i]
+            labels:=format_labels(bucket_label_names, append(append([]string{}, series.label_values...), format_metric_value(bound)))
+            fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, cumulative)
+        }
+        labels:=format_labels(bucket_label_names, append(append([]string{}, series.label_values...), "+Inf"))
+        fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, series.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, format_metric_value(series.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, series.count)
+    }
+}
+
+// What the server counts, served at /metrics in the Prometheus text format. A nil Metrics
+// counts nothing.
+type Metrics struct{
+    lock *sync.Mutex
+    requests *Value_vec
+    request_duration *Histogram_vec
+    bookings_added *Value_vec
+    bookings_removed *Value_vec
+    failed_logins *Value_vec
+    save_duration *Histogram_vec
+    save_size *Value_vec
+    save_errors *Value_vec
+    lock_wait *Histogram_vec
+    // Gauges that are read when the metrics are served
+    gauges []*Value_vec
+    gauge_functions []func() float64
+}
+
+func new_metrics() *Metrics{
+    return &Metrics{
+        lock: &sync.Mutex{},
+        requests: new_value_vec("kathrin_http_requests_total", "HTTP requests by handler and status code.", "counter", "handler", "code"),
+        request_duration: new_histogram_vec("kathrin_http_request_duration_seconds", "Time taken to answer HTTP requests by handler and status code.", request_duration_buckets, "handler", "code"),
+        bookings_added: new_value_vec("kathrin_bookings_added_total", "Entries booked.", "counter"),
+        bookings_removed: new_value_vec("kathrin_bookings_removed_total", "Entries removed (including archived ones).", "counter"),
+        failed_logins: new_value_vec("kathrin_failed_logins_total", "Failed authentications by reason.", "counter", "reason"),
+        save_duration: new_histogram_vec("kathrin_save_duration_seconds", "Time taken to write the data file.", save_duration_buckets),
+        save_size: new_value_vec("kathrin_save_size_bytes", "Size of the data file when it was last written.", "gauge"),
+        save_errors: new_value_vec("kathrin_save_errors_total", "Failed writes of the data file.", "counter"),
+        lock_wait: new_histogram_vec("kathrin_users_lock_wait_seconds", "Time spent waiting for the lock on the users and entries, by mode (read or write).", lock_wait_buckets, "mode"),
+    }
+}
+
+// Adds a gauge whose value is asked for when the metrics are served. Must be called
+// before the metrics are shared.
+func (m *Metrics) add_gauge(name, help string, value func() float64){
+    m.gauges=append(m.gauges, new_value_vec(name, help, "gauge"))
+    m.gauge_functions=append(m.gauge_functions, value)
+}
+
+func (m *Metrics) observe_request(handler string, code int, duration time.Duration){
+    if m==nil{
+        return
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    m.requests.add(1, handler, strconv.Itoa(code))
+    m.request_duration.observe(duration.Seconds(), handler, strconv.Itoa(code))
+}
+
+// Is a listener of the users' changes, so it must not block
+func (m *Metrics) observe_changes(changes []Change){
+    if m==nil{
+        return
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    for _,change:=range changes{
+        if change.Added{
+            m.bookings_added.add(1)
+        } else{
+            m.bookings_removed.add(1)
+        }
+    }
+}
+
+func (m *Metrics) failed_login(reason string){
+    if m==nil{
+        return
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    m.failed_logins.add(1, reason)
+}
+
+func (m *Metrics) observe_save(duration time.Duration, size int, err error){
+    if m==nil{
+        return
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    m.save_duration.observe(duration.Seconds())
+    if err!=nil{
+        m.save_errors.add(1)
+        return
+    }
+    m.save_size.set(float64(size))
+}
+
+func (m *Metrics) observe_lock_wait(mode string, wait time.Duration){
+    if m==nil{
+        return
+    }
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    m.lock_wait.observe(wait.Seconds(), mode)
+}
+
+// Renders every metric in the Prometheus text format. Nothing is written while the lock
+// is held, so a slow client cannot hold up the requests that are counted.
+func (m *Metrics) render() []byte{
+    // Read before locking, the functions may take other locks
+    gauge_values:=[]float64{}
+    for _,value:=range m.gauge_functions{
+        gauge_values=append(gauge_values, value())
+    }
+
+    m.lock.Lock()
+    defer m.lock.Unlock()
+
+    var buffer bytes.Buffer
+    m.requests.write(&buffer)
+    m.request_duration.write(&buffer)
+    m.bookings_added.write(&buffer)
+    m.bookings_removed.write(&buffer)
+    m.failed_logins.write(&buffer)
+    m.save_duration.write(&buffer)
+    m.save_size.write(&buffer)
+    m.save_errors.write(&buffer)
+    m.lock_wait.write(&buffer)
+    for i,gauge:=range m.gauges{
+        gauge.set(gauge_values[i])
+        gauge.write(&buffer)
+    }
+    return buffer.Bytes()
+}
+
+// Expects a GET request
+func (m *Metrics) http_metrics(w http.ResponseWriter, r *http.Request){
+    if r.Method!="GET"{
+        http.Error(w, "Request to this address must be GET.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.Write(m.render())
+}
+
+// Remembers the status code a handler answered with
+type Status_recorder struct{
+    http.ResponseWriter
+    code int
+}
+
+func (s *Status_recorder) WriteHeader(code int){
+    s.code=code
+    s.ResponseWriter.WriteHeader(code)
+}
+
+// Event streams need to flush
+func (s *Status_recorder) Flush(){
+    if flusher, ok:=s.ResponseWriter.(http.Flusher);ok{
+        flusher.Flush()
+    }
+}
+
+// Counts the requests by the pattern of the mux they go to, so unknown paths do not
+// make up new handlers
+func (m *Metrics) wrap(mux *http.ServeMux, handler http.Handler) http.Handler{
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        _, pattern:=mux.Handler(r)
+        recorder:=&Status_recorder{w, http.StatusOK}
+        start:=time.Now()
+        handler.ServeHTTP(recorder, r)
+        m.observe_request(pattern, recorder.code, time.Since(start))
+    })
+}
+
+// A lock that tells how long it took to get it
+type Timed_rwmutex struct{
+    sync.RWMutex
+    // May be nil
+    observe func(mode string, wait time.Duration)
+}
+
+func (l *Timed_rwmutex) Lock(){
+    if l.observe==nil{
+        l.RWMutex.Lock()
+        return
+    }
+    start:=time.Now()
+    l.RWMutex.Lock()
+    l.observe("write", time.Since(start))
+}
+
+func (l *Timed_rwmutex) RLock(){
+    if l.observe==nil{
+        l.RWMutex.RLock()
+        return
+    }
+    start:=time.Now()
+    l.RWMutex.RLock()
+    l.observe("read", time.Since(start))
+}
+
+// Makes the users report to the metrics. Must be called before the users are shared.
+func (u *Users) set_metrics(metrics *Metrics){
+    u.metrics=metrics
+    u.lock.observe=metrics.observe_lock_wait
+    u.add_listener(metrics.observe_changes)
+    metrics.add_gauge("kathrin_bookings", "Entries currently booked.", func() float64{
+        return float64(u.count_bookings())
+    })
+    metrics.add_gauge("kathrin_users", "Users, including disabled ones.", func() float64{
+        return float64(u.count_users())
+    })
+}
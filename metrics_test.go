@@ -0,0 +1,125 @@
+package main;
+
+import "bytes"
+import "errors"
+import "net/http"
+import "net/http/httptest"
+import "strings"
+import "testing"
+import "time"
+
+func TestFormat_labels(t *testing.T){
+    if format_labels(nil, nil)!=""{
+        t.Error()
+    }
+    if format_labels([]string{"a", "b"}, []string{"x", "\"\\\n"})!=`{a="x",b="\"\\\n"}`{
+        t.Error(format_labels([]string{"a", "b"}, []string{"x", "\"\\\n"}))
+    }
+}
+
+func TestHistogram_vec(t *testing.T){
+    histogram:=new_histogram_vec("h", "A histogram.", []float64{1, 2}, "mode")
+    histogram.observe(0.5, "read")
+    histogram.observe(1.5, "read")
+    histogram.observe(3, "read")
+
+    var b bytes.Buffer
+    histogram.write(&b)
+    expected:=`# HELP h A histogram.
+# TYPE h histogram
+h_bucket{mode="read",le="1"} 1
+h_bucket{mode="read",le="2"} 2
+h_bucket{mode="read",le="+Inf"} 3
+h_sum{mode="read"} 5
+h_count{mode="read"} 3
+`
+    if b.String()!=expected{
+        t.Error(b.String())
+    }
+}
+
+func TestMetrics(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    metrics:=new_metrics()
+    users.set_metrics(metrics)
+
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,4})
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,5})
+    users.remove_entry(Actor{}, "a", Entry{2017,2,3,4})
+    users.authenticate(httptest.NewRequest("POST", "/", nil), "a", "wrong")
+    metrics.observe_save(time.Millisecond, 100, nil)
+    metrics.observe_save(time.Millisecond, 200, errors.New("Could not save"))
+
+    mux:=http.NewServeMux()
+    mux.HandleFunc("/add_entry", func(w http.ResponseWriter, r *http.Request){
+        http.Error(w, "No", http.StatusBadRequest)
+    })
+    mux.HandleFunc("/metrics", metrics.http_metrics)
+    handler:=metrics.wrap(mux, mux)
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/add_entry", nil))
+    // Unknown paths are not counted by path
+    handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/nothing", nil))
+
+    w:=httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+    output:=w.Body.String()
+    for _,line:=range []string{
+        `kathrin_http_requests_total{handler="/add_entry",code="400"} 1`,
+        `kathrin_http_requests_total{handler="",code="404"} 1`,
+        `kathrin_http_request_duration_seconds_count{handler="/add_entry",code="400"} 1`,
+        `kathrin_bookings_added_total 2`,
+        `kathrin_bookings_removed_total 1`,
+        `kathrin_failed_logins_total{reason="wrong_password"} 1`,
+        `kathrin_save_duration_seconds_count 2`,
+        `kathrin_save_size_bytes 100`,
+        `kathrin_save_errors_total 1`,
+        `kathrin_bookings 1`,
+        `kathrin_users 1`,
+    }{
+        if !strings.Contains(output, line+"\n"){
+            t.Error(line)
+        }
+    }
+    if !strings.Contains(output, `kathrin_users_lock_wait_seconds_count{mode="write"}`) || !strings.Contains(output, `kathrin_users_lock_wait_seconds_count{mode="read"}`){
+        t.Error()
+    }
+
+    // Nil metrics count nothing
+    var nil_metrics *Metrics
+    nil_metrics.observe_request("/", 200, time.Second)
+    nil_metrics.failed_login("blocked")
+}
+
+// Answers the metrics request but does not take the body until released
+type Blocking_writer struct{
+    *httptest.ResponseRecorder
+    writing chan struct{}
+    release chan struct{}
+}
+
+func (b *Blocking_writer) Write(data []byte) (int, error){
+    close(b.writing)
+    <-b.release
+    return b.ResponseRecorder.Write(data)
+}
+
+func TestMetricsHttp_metricsSlow_client(t *testing.T){
+    metrics:=new_metrics()
+    w:=&Blocking_writer{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+    go metrics.http_metrics(w, httptest.NewRequest("GET", "/metrics", nil))
+    <-w.writing
+
+    // Requests are still counted while the client takes its time
+    counted:=make(chan struct{})
+    go func(){
+        metrics.observe_request("/", 200, time.Millisecond)
+        close(counted)
+    }()
+    select{
+    case <-counted:
+    case <-time.After(time.Second):
+        t.Error()
+    }
+    close(w.release)
+}
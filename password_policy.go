@@ -0,0 +1,249 @@
+package main;
+
+import "bufio"
+import "crypto/pbkdf2"
+import "crypto/rand"
+import "crypto/sha256"
+import "crypto/subtle"
+import "encoding/hex"
+import "errors"
+import "fmt"
+import "os"
+import "strconv"
+import "strings"
+import "sync"
+import "unicode"
+
+// The Unicode classes passwords may be made of, by the names used in the configuration
+var password_classes=map[string]*unicode.RangeTable{
+    "letter": unicode.Letter,
+    "mark": unicode.Mark,
+    "digit": unicode.Nd,
+    "number": unicode.Number,
+    "punct": unicode.Punct,
+    "symbol": unicode.Symbol,
+    "space": unicode.Zs,
+}
+
+// Parses a comma separated list of class names
+func parse_password_classes(value string) ([]*unicode.RangeTable, error){
+    classes:=[]*unicode.RangeTable{}
+    for _,name:=range strings.Split(value, ","){
+        name=strings.TrimSpace(name)
+        class, ok:=password_classes[name]
+        if !ok{
+            return nil, fmt.Errorf("Unknown character class %q", name)
+        }
+        classes=append(classes, class)
+    }
+    return classes, nil
+}
+
+// Decides which passwords may be used as new passwords
+type Password_policy struct{
+    min_length int
+    max_length int
+    classes []*unicode.RangeTable
+    // How many of a user's previous passwords cannot be used again
+    history int
+    denylist_file string
+    // Read when first needed
+    lock *sync.Mutex
+    denylist map[string]bool
+    denylist_error error
+}
+
+// The configuration has to be valid
+func new_password_policy(config Config) *Password_policy{
+    classes, _:=parse_password_classes(config.Password_classes)
+    return &Password_policy{
+        min_length: config.Min_password_length,
+        max_length: config.Max_password_length,
+        classes: classes,
+        history: config.Password_history,
+        denylist_file: config.Password_denylist_file,
+        lock: &sync.Mutex{},
+    }
+}
+
+// Reads the denylist (one password per line, lines starting with # are comments) once
+func (p *Password_policy) load_denylist() (map[string]bool, error){
+    p.lock.Lock()
+    defer p.lock.Unlock()
+
+    if p.denylist!=nil || p.denylist_error!=nil || p.denylist_file==""{
+        return p.denylist, p.denylist_error
+    }
+
+    f, err:=os.Open(p.denylist_file)
+    if err!=nil{
+        p.denylist_error=err
+        return nil, err
+    }
+    defer f.Close()
+
+    denylist:=make(map[string]bool)
+    scanner:=bufio.NewScanner(f)
+    for scanner.Scan(){
+        line:=strings.TrimSpace(scanner.Text())
+        if line=="" || strings.HasPrefix(line, "#"){
+            continue
+        }
+        denylist[strings.ToLower(line)]=true
+    }
+    if scanner.Err()!=nil{
+        p.denylist_error=scanner.Err()
+        return nil, p.denylist_error
+    }
+    p.denylist=denylist
+    return denylist, nil
+}
+
+// Checks whether a password may become the user's new password. The user is nil for
+// users that do not exist yet. A nil policy accepts every password.
+func (p *Password_policy) validate(password string, user *User) error{
+    if p==nil{
+        return nil
+    }
+
+    // If the new password's length is not within bounds
+    length:=len([]rune(password))
+    if length<p.min_length || length>p.max_length{
+        return fmt.Errorf("New password's length must be between %d and %d characters", p.min_length, p.max_length)
+    }
+
+    for _,password_char:=range password{
+        if !unicode.IsOneOf(p.classes, password_char){
+            return fmt.Errorf("New password may not contain %q", password_char)
+        }
+    }
+
+    denylist, err:=p.load_denylist()
+    if err!=nil{
+        // Rather refuse every password than let common ones through
+        return fmt.Errorf("Passwords cannot be checked: %s", err)
+    }
+    if denylist[strings.ToLower(password)]{
+        return errors.New("New password is too common")
+    }
+
+    if user!=nil && p.history>0{
+        if user.Password==password{
+            return errors.New("New password must differ from the current one")
+        }
+        for i:=0; i<len(user.Previous_passwords) && i<p.history-1; i++{
+            if previous_password_matches(user.Previous_passwords[i], password){
+                return fmt.Errorf("New password cannot be one of the last %d passwords", p.history)
+            }
+        }
+    }
+
+    return nil
+}
+
+// How many previous passwords are kept
+func (p *Password_policy) keep() int{
+    if p==nil || p.history<=1{
+        return 0
+    }
+    return p.history-1
+}
+
+var error_password_changed=errors.New("The password was changed in the meantime, try again")
+
+// A new password that was checked, with a hash of the one it replaces. Working these out
+// is slow, so it is done before the users' lock is taken (see prepare).
+type Password_change struct{
+    password string
+    // The change only applies while this is still the user's password
+    replaces string
+    replaces_hash string
+}
+
+// Checks a new password for a user (nil for a new one) and hashes the user's current
+// password. Meant to be called without the lock, on a copy of the user.
+func (p *Password_policy) prepare(password string, user *User) (Password_change, error){
+    err:=p.validate(password, user)
+    if err!=nil{
+        return Password_change{}, err
+    }
+
+    change:=Password_change{password: password}
+    if user!=nil{
+        change.replaces=user.Password
+        if p.keep()>0{
+            change.replaces_hash, err=hash_previous_password(user.Password)
+            if err!=nil{
+                return Password_change{}, err
+            }
+        }
+    }
+    return change, nil
+}
+
+// Sets a user's password, remembering a hash of the old one as the policy requires. Fails
+// if the password changed since the change was prepared.
+func (p *Password_policy) set_password(user *User, change Password_change) error{
+    if user.Password!=change.replaces{
+        return error_password_changed
+    }
+
+    keep:=p.keep()
+    previous:=[]string{}
+    if keep>0 && change.replaces_hash!=""{
+        previous=append(previous, change.replaces_hash)
+    }
+    previous=append(previous, user.Previous_passwords...)
+    if len(previous)>keep{
+        previous=previous[:keep]
+    }
+    if len(previous)==0{
+        previous=nil
+    }
+    user.Previous_passwords=previous
+    user.Password=change.password
+    return nil
+}
+
+// How previous passwords are hashed, the parameters are stored along with every hash
+const previous_password_scheme="pbkdf2-sha256"
+const previous_password_iterations=100000
+
+// Returns a salted hash like pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hash_previous_password(password string) (string, error){
+    salt:=make([]byte, 16)
+    _, err:=rand.Read(salt)
+    if err!=nil{
+        return "", err
+    }
+    return hash_previous_password_with(password, previous_password_iterations, salt)
+}
+
+func hash_previous_password_with(password string, iterations int, salt []byte) (string, error){
+    hash, err:=pbkdf2.Key(sha256.New, password, salt, iterations, 32)
+    if err!=nil{
+        return "", err
+    }
+    return fmt.Sprintf("%s$%d$%s$%s", previous_password_scheme, iterations, hex.EncodeToString(salt), hex.EncodeToString(hash)), nil
+}
+
+func is_previous_password_hash(value string) bool{
+    return strings.HasPrefix(value, previous_password_scheme+"$")
+}
+
+func previous_password_matches(hash string, password string) bool{
+    parts:=strings.Split(hash, "$")
+    if len(parts)!=4 || parts[0]!=previous_password_scheme{
+        return false
+    }
+    iterations, err:=strconv.Atoi(parts[1])
+    if err!=nil || iterations<1{
+        return false
+    }
+    salt, err:=hex.DecodeString(parts[2])
+    if err!=nil{
+        return false
+    }
+    candidate, err:=hash_previous_password_with(password, iterations, salt)
+    return err==nil && subtle.ConstantTimeCompare([]byte(candidate), []byte(hash))==1
+}
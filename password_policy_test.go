@@ -0,0 +1,111 @@
+package main;
+
+import "io/ioutil"
+import "os"
+import "strings"
+import "testing"
+
+func TestPassword_policyValidate(t *testing.T){
+    err:=ioutil.WriteFile("DELETEME.txt", []byte("# comment\nPassword1\n\nletmein\n"), 0644)
+    if err!=nil{
+        panic("Could not create temporary file")
+    }
+
+    config:=default_config()
+    config.Min_password_length=6
+    config.Max_password_length=20
+    config.Password_classes="letter,digit,space"
+    config.Password_denylist_file="DELETEME.txt"
+    config.Password_history=2
+    policy:=new_password_policy(config)
+
+    // Length counts characters, not bytes
+    if policy.validate("äöüäö", nil)==nil || policy.validate("äöüäöü", nil)!=nil || policy.validate("abcdefghijklmnopqrstu", nil)==nil{
+        t.Error()
+    }
+    // Classes
+    if policy.validate("correct horse", nil)!=nil || policy.validate("correct-horse", nil)==nil{
+        t.Error()
+    }
+    // Denylist, ignoring case
+    if policy.validate("PASSWORD1", nil)==nil || policy.validate("letmein", nil)==nil{
+        t.Error()
+    }
+    // History
+    user:=User{"a", "first one", nil, false, nil}
+    if policy.validate("first one", &user)==nil{
+        t.Error()
+    }
+    set_password:=func(password string) error{
+        change, err:=policy.prepare(password, &user)
+        if err!=nil{
+            return err
+        }
+        return policy.set_password(&user, change)
+    }
+    set_password("second one")
+    if policy.validate("first one", &user)==nil || policy.validate("third one", &user)!=nil || set_password("first one")==nil{
+        t.Error()
+    }
+    set_password("third one")
+    set_password("fourth one")
+    // Only salted hashes of previous passwords are kept
+    if len(user.Previous_passwords)!=1 || strings.Contains(user.Previous_passwords[0], "third one") || !previous_password_matches(user.Previous_passwords[0], "third one") || policy.validate("third one", &user)==nil || policy.validate("second one", &user)!=nil{
+        t.Error(user.Previous_passwords)
+    }
+    // A change is refused if the password changed after it was prepared
+    change, _:=policy.prepare("fifth one", &user)
+    set_password("sixth one")
+    if policy.set_password(&user, change)!=error_password_changed || user.Password!="sixth one"{
+        t.Error()
+    }
+
+    err=os.Remove("DELETEME.txt")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+
+    // A missing denylist refuses everything
+    config.Password_denylist_file="DELETEME.missing"
+    if new_password_policy(config).validate("correct horse", nil)==nil{
+        t.Error()
+    }
+    // No policy accepts everything
+    var no_policy *Password_policy
+    if no_policy.validate("a", nil)!=nil{
+        t.Error()
+    }
+}
+
+func TestUsersPassword_policy(t *testing.T){
+    config:=default_config()
+    config.Password_denylist_file=""
+    users:=new_users()
+    users.configure(config)
+    users.audit_log=nil
+
+    if users.add_user(Actor{}, "a", "short")==nil || users.add_user(Actor{}, "a", "long enough")!=nil{
+        t.Error()
+    }
+    if users.change_password(Actor{}, "a", "long enough", "long enough")==nil || users.change_password(Actor{}, "a", "long enough", "even longer")!=nil{
+        t.Error()
+    }
+    if users.reset_password(Actor{}, "a", "long enough")==nil || users.reset_password(Actor{}, "a", "brand new one")!=nil{
+        t.Error()
+    }
+    results:=users.provision_users(Actor{}, []Provision_row{{"a", "even longer"}, {"b", "tiny"}}, true)
+    if results[0].Status!="error" || results[1].Status!="error"{
+        t.Error(results)
+    }
+}
+
+func TestPrevious_password_hash(t *testing.T){
+    first, err:=hash_previous_password("password")
+    second, _:=hash_previous_password("password")
+    if err!=nil || !is_previous_password_hash(first) || first==second{
+        t.Error(first)
+    }
+    if !previous_password_matches(first, "password") || previous_password_matches(first, "Password") || previous_password_matches("password", "password"){
+        t.Error()
+    }
+}
@@ -0,0 +1,316 @@
+package main;
+
+import "crypto/rand"
+import "encoding/csv"
+import "encoding/json"
+import "errors"
+import "flag"
+import "fmt"
+import "io"
+import "math/big"
+import "net/http"
+import "os"
+import "strings"
+
+// Length of the passwords generated for new users
+const generated_password_length=10
+
+// A user to be created (or updated). An empty password means one is generated.
+type Provision_row struct{
+    Name string `json:"name"`
+    Password string `json:"password"`
+}
+
+// What happened to a row: "created", "updated", "conflict" (the user exists and was left
+// alone) or "error"
+type Provision_result struct{
+    Name string
+    Password string
+    Status string
+    Error string
+}
+
+// Returns a string of random characters taken from the given ones
+func random_string(characters []rune, length int) (string, error){
+    ret:=make([]rune, length)
+    for i:=0; i<len(ret); i++{
+        n, err:=rand.Int(rand.Reader, big.NewInt(int64(len(characters))))
+        if err!=nil{
+            return "", err
+        }
+        ret[i]=characters[n.Int64()]
+    }
+    return string(ret), nil
+}
+
+// Reads lines of "name[,password]". A first line with "name" in its first column is a header.
+func parse_provision_csv(reader io.Reader) ([]Provision_row, error){
+    csv_reader:=csv.NewReader(reader)
+    csv_reader.FieldsPerRecord=-1
+    csv_reader.TrimLeadingSpace=true
+    records, err:=csv_reader.ReadAll()
+    if err!=nil{
+        return nil, err
+    }
+
+    rows:=[]Provision_row{}
+    for i,record:=range records{
+        if i==0 && strings.EqualFold(strings.TrimSpace(record[0]), "name"){
+            continue
+        }
+        if len(record)>2{
+            return nil, fmt.Errorf("Line %d: expected at most two columns (name, password)", i+1)
+        }
+
+        row:=Provision_row{strings.TrimSpace(record[0]), ""}
+        if len(record)==2{
+            row.Password=strings.TrimSpace(record[1])
+        }
+        rows=append(rows, row)
+    }
+
+    return rows, nil
+}
+
+// Reads a json list of {"name": ..., "password": ...} objects
+func parse_provision_json(reader io.Reader) ([]Provision_row, error){
+    rows:=[]Provision_row{}
+    err:=json.NewDecoder(reader).Decode(&rows)
+    if err!=nil{
+        return nil, err
+    }
+    return rows, nil
+}
+
+func parse_provision_rows(reader io.Reader, format string) ([]Provision_row, error){
+    switch format{
+    case "csv":
+        return parse_provision_csv(reader)
+    case "json":
+        return parse_provision_json(reader)
+    }
+    return nil, errors.New("Format must be csv or json")
+}
+
+// Creates the users of the rows under a single lock. Existing users are reported as
+// conflicts, unless update_existing is set, in which case their password is replaced.
+func (u *Users) provision_users(actor Actor, rows []Provision_row, update_existing bool) (results []Provision_result){
+    results=make([]Provision_result, len(rows))
+    for i,row:=range rows{
+        results[i]=Provision_result{row.Name, row.Password, "", ""}
+        if row.Name==""{
+            results[i].Status, results[i].Error="error", "Name cannot be an empty string"
+            continue
+        }
+        if row.Name=="admin"{
+            results[i].Status, results[i].Error="error", "The admin user cannot be provisioned"
+            continue
+        }
+
+        if row.Password==""{
+            password, err:=u.config.generate_password()
+            if err!=nil{
+                results[i].Status, results[i].Error="error", err.Error()
+                continue
+            }
+            results[i].Password=password
+        }
+    }
+
+    // New passwords of existing users are checked against their history and the old ones
+    // hashed before the lock is taken, as that is slow
+    changes:=make([]Password_change, len(results))
+    change_errors:=make([]error, len(results))
+    for i:=0; i<len(results) && update_existing; i++{
+        current, err:=u.get_user_copy(results[i].Name)
+        if results[i].Status=="" && err==nil{
+            changes[i], change_errors[i]=u.password_policy.prepare(results[i].Password, &current)
+        }
+    }
+
+    defer func(){
+        audit_provisioned(u, actor, results)
+    }()
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    changed:=false
+    seen:=make(map[string]bool)
+    for i:=0; i<len(results); i++{
+        if results[i].Status!=""{
+            continue
+        }
+        if seen[results[i].Name]{
+            results[i].Status, results[i].Error="error", "Name appears more than once"
+            continue
+        }
+        seen[results[i].Name]=true
+
+        index:=-1
+        for j:=0; j<len(u.users); j++{
+            if u.users[j].Name==results[i].Name{
+                index=j
+                break
+            }
+        }
+
+        if index<0{
+            err:=u.password_policy.validate(results[i].Password, nil)
+            if err!=nil{
+                results[i].Status, results[i].Error="error", err.Error()
+                continue
+            }
+            u.users=append(u.users, User{results[i].Name, results[i].Password, []Entry{}, false, nil})
+            results[i].Status="created"
+            changed=true
+        } else if update_existing{
+            err:=change_errors[i]
+            if err==nil{
+                err=u.password_policy.set_password(&u.users[index], changes[i])
+            }
+            if err!=nil{
+                results[i].Status, results[i].Error="error", err.Error()
+                continue
+            }
+            results[i].Status="updated"
+            changed=true
+        } else{
+            results[i].Status, results[i].Error="conflict", "A user with that name already exists"
+        }
+    }
+
+    if changed{
+        u.notify(nil)
+    }
+    return results
+}
+
+// Writes the results as a csv sheet (name, password, status, error) to be handed out.
+// Passwords are only listed for users that were created or updated.
+func write_credential_sheet(writer io.Writer, results []Provision_result) error{
+    csv_writer:=csv.NewWriter(writer)
+    csv_writer.Write([]string{"name", "password", "status", "error"})
+    for _,result:=range results{
+        password:=""
+        if result.Status=="created" || result.Status=="updated"{
+            password=result.Password
+        }
+        csv_writer.Write([]string{result.Name, password, result.Status, result.Error})
+    }
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+func audit_provisioned(u *Users, actor Actor, results []Provision_result){
+    for _,result:=range results{
+        if result.Status=="created"{
+            u.audit(actor.Request, actor.Name, "create_user", result.Name, "", "")
+        } else if result.Status=="updated"{
+            u.audit(actor.Request, actor.Name, "reset_password", result.Name, "", "")
+        }
+    }
+}
+
+func count_provisioned(results []Provision_result) int{
+    provisioned:=0
+    for _,result:=range results{
+        if result.Status=="created" || result.Status=="updated"{
+            provisioned++
+        }
+    }
+    return provisioned
+}
+
+// Usage: kathrin provision [-format csv|json] [-update] <file>
+// The credential sheet is written to stdout.
+func run_provision(args []string) int{
+    var format *string
+    var update_existing *bool
+    config, args_left, ok:=parse_cli_flags("provision", args, func(flags *flag.FlagSet){
+        format=flags.String("format", "csv", "format of the input file (csv or json)")
+        update_existing=flags.Bool("update", false, "reset the passwords of users that already exist")
+    })
+    if !ok{
+        return 2
+    }
+    if len(args_left)!=1{
+        fmt.Fprint(os.Stderr, cli_usage)
+        return 2
+    }
+
+    f, err:=os.Open(args_left[0])
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    rows, err:=parse_provision_rows(f, *format)
+    f.Close()
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    var results []Provision_result
+    status:=change_data(config, func(users *Users) error{
+        results=users.provision_users(Actor{"cli", nil}, rows, *update_existing)
+        return nil
+    })
+    if status!=0{
+        return status
+    }
+
+    err=write_credential_sheet(os.Stdout, results)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+    return 0
+}
+
+// Expects a form POST with admin_password, format (csv or json), data and optionally
+// update_existing. Answers with the credential sheet as a csv file.
+func (u *Users) http_provision_users(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // Keys may create users, but not reset the passwords of existing ones
+    if r.FormValue("update_existing")!="" && api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    rows, err:=parse_provision_rows(strings.NewReader(r.FormValue("data")), r.FormValue("format"))
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    results:=u.provision_users(Actor{"admin", r}, rows, r.FormValue("update_existing")!="")
+    provisioned:=count_provisioned(results)
+    if provisioned>0{
+        u.Sort()
+        // Save changes to file
+        err=u.to_file(u.config.Data_file)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+        }
+    }
+    fmt.Println("Users provisioned:", provisioned, "of", len(rows))
+
+    w.Header().Set("Content-Type", "text/csv")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"credentials.csv\"")
+    w.Header().Set("Cache-Control", "no-store")
+    write_credential_sheet(w, results)
+}
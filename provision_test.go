@@ -0,0 +1,87 @@
+package main;
+
+import "testing"
+import "bytes"
+import "strings"
+
+func TestParse_provision_csv(t *testing.T){
+    rows, err:=parse_provision_csv(strings.NewReader("name,password\n101\n102, secret\n"))
+    if err!=nil{
+        t.Error(err)
+        return
+    }
+
+    if len(rows)!=2 || rows[0].Name!="101" || rows[0].Password!="" || rows[1].Name!="102" || rows[1].Password!="secret"{
+        t.Error()
+    }
+
+    _, err=parse_provision_csv(strings.NewReader("101,a,b\n"))
+    if err==nil{
+        t.Error()
+    }
+}
+
+func TestParse_provision_json(t *testing.T){
+    rows, err:=parse_provision_rows(strings.NewReader(`[{"name": "101"}, {"name": "102", "password": "secret"}]`), "json")
+    if err!=nil || len(rows)!=2 || rows[1].Password!="secret"{
+        t.Error()
+    }
+
+    _, err=parse_provision_rows(strings.NewReader(""), "xml")
+    if err==nil{
+        t.Error()
+    }
+}
+
+func TestRandom_string(t *testing.T){
+    s, err:=random_string([]rune("aä"), 100)
+    if err!=nil || len([]rune(s))!=100 || strings.Trim(s, "aä")!=""{
+        t.Error()
+    }
+
+    if !strings.Contains(s, "a") || !strings.Contains(s, "ä"){
+        t.Error()
+    }
+}
+
+func TestUsersProvision_users(t *testing.T){
+    config:=default_config()
+    config.Min_password_length=4
+    config.Password_denylist_file=""
+    users:=new_users()
+    users.configure(config)
+    users.audit_log=nil
+    users.add_user(Actor{}, "101", "password")
+
+    rows:=[]Provision_row{
+        Provision_row{"101", ""},
+        Provision_row{"102", ""},
+        Provision_row{"103", "secret"},
+        Provision_row{"103", ""},
+        Provision_row{"104", "ab"},
+        Provision_row{"", ""},
+    }
+
+    results:=users.provision_users(Actor{}, rows, false)
+    statuses:=[]string{"conflict", "created", "created", "error", "error", "error"}
+    for i,status:=range statuses{
+        if results[i].Status!=status{
+            t.Error(i, results[i])
+        }
+    }
+
+    if len(users.users)!=3 || users.users[0].Password!="password" || users.users[1].Password!=results[1].Password || users.users[2].Password!="secret"{
+        t.Error()
+    }
+
+    results=users.provision_users(Actor{}, rows[:1], true)
+    if results[0].Status!="updated" || users.users[0].Password!=results[0].Password{
+        t.Error()
+    }
+
+    sheet:=bytes.Buffer{}
+    write_credential_sheet(&sheet, []Provision_result{Provision_result{"101", "pw", "created", ""}, Provision_result{"102", "pw", "conflict", "exists"}})
+    if sheet.String()!="name,password,status,error\n101,pw,created,\n102,,conflict,exists\n"{
+        t.Error(sheet.String())
+    }
+}
@@ -0,0 +1,208 @@
+package main;
+
+import "context"
+import "net/http"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+// Allows bursts of up to burst requests and rate requests per second after that. It is
+// not safe for concurrent use, its owner has to lock it.
+type Token_bucket struct{
+    rate float64
+    burst float64
+    tokens float64
+    last time.Time
+}
+
+func new_token_bucket(rate float64, burst float64, now time.Time) *Token_bucket{
+    return &Token_bucket{rate, burst, burst, now}
+}
+
+// Adds the tokens that came in since the last call
+func (b *Token_bucket) refill(now time.Time){
+    if now.After(b.last){
+        b.tokens+=now.Sub(b.last).Seconds()*b.rate
+        if b.tokens>b.burst{
+            b.tokens=b.burst
+        }
+        b.last=now
+    }
+}
+
+// How long it takes until there is a token, without taking it
+func (b *Token_bucket) wait(now time.Time) time.Duration{
+    b.refill(now)
+    if b.tokens>=1{
+        return 0
+    }
+    return time.Duration((1-b.tokens)/b.rate*float64(time.Second))
+}
+
+// Takes a token if there is one, otherwise tells how long it takes until there is
+func (b *Token_bucket) take(now time.Time) (bool, time.Duration){
+    wait:=b.wait(now)
+    if wait>0{
+        return false, wait
+    }
+    b.tokens--
+    return true, 0
+}
+
+// What a request is counted as
+type Rate_category string
+
+const(
+    rate_read Rate_category="read"
+    rate_write Rate_category="write"
+    // Every password check, successful or not
+    rate_auth Rate_category="auth"
+)
+
+// Buckets that were not used for this long are full again and can be forgotten
+const rate_limiter_prune_interval=time.Minute
+
+// Limits how many requests each client may make per minute. Clients are counted by
+// address, by api key and by user, every one of them with separate buckets for reads,
+// writes and auth attempts.
+type Rate_limiter struct{
+    lock *sync.Mutex
+    // Requests per minute of each category, which is also the burst. 0 means no limit.
+    per_minute map[Rate_category]int
+    buckets map[string]*Token_bucket
+    last_pruned time.Time
+    now func() time.Time
+}
+
+func new_rate_limiter(config Config) *Rate_limiter{
+    return &Rate_limiter{
+        lock: &sync.Mutex{},
+        per_minute: map[Rate_category]int{
+            rate_read: config.Rate_limit_reads_per_minute,
+            rate_write: config.Rate_limit_writes_per_minute,
+            rate_auth: config.Rate_limit_auth_per_minute,
+        },
+        buckets: make(map[string]*Token_bucket),
+        last_pruned: time.Now(),
+        now: time.Now,
+    }
+}
+
+// Takes a token from the bucket of every client if all of them have one, otherwise returns
+// how long to wait. A nil limiter allows everything.
+func (l *Rate_limiter) take(category Rate_category, clients ...string) time.Duration{
+    if l==nil || l.per_minute[category]<=0{
+        return 0
+    }
+
+    l.lock.Lock()
+    defer l.lock.Unlock()
+
+    now:=l.now()
+    if now.Sub(l.last_pruned)>=rate_limiter_prune_interval{
+        for client,bucket:=range l.buckets{
+            bucket.refill(now)
+            if bucket.tokens>=bucket.burst{
+                delete(l.buckets, client)
+            }
+        }
+        l.last_pruned=now
+    }
+
+    per_minute:=float64(l.per_minute[category])
+    buckets:=[]*Token_bucket{}
+    wait:=time.Duration(0)
+    for _,client:=range clients{
+        bucket:=l.buckets[string(category)+" "+client]
+        if bucket==nil{
+            bucket=new_token_bucket(per_minute/60, per_minute, now)
+            l.buckets[string(category)+" "+client]=bucket
+        }
+        if bucket_wait:=bucket.wait(now);bucket_wait>wait{
+            wait=bucket_wait
+        }
+        buckets=append(buckets, bucket)
+    }
+    if wait>0{
+        return wait
+    }
+
+    for _,bucket:=range buckets{
+        bucket.take(now)
+    }
+    return 0
+}
+
+// Routes that only read, everything else counts as a write. The frontend posts to
+// /get_entries, so the method does not tell.
+var rate_read_routes=map[string]bool{
+    "/": true,
+    "/csrf.js": true,
+    "/get_entries": true,
+    "/events": true,
+    "/see_all": true,
+    "/export_raw": true,
+    "/export_data": true,
+    "/audit_log": true,
+    "/statistics": true,
+    "/calendar/": true,
+    "/healthz": true,
+    "/readyz": true,
+    "/metrics": true,
+}
+
+// Classifies a request by the pattern of the mux it goes to
+func rate_category_of(mux *http.ServeMux, r *http.Request) Rate_category{
+    _, pattern:=mux.Handler(r)
+    if rate_read_routes[pattern] || strings.HasPrefix(pattern, "/bootstrap/"){
+        return rate_read
+    }
+    return rate_write
+}
+
+type rate_category_context_key struct{}
+
+// The category wrap counted the request as, if it went through it
+func rate_category_from_request(r *http.Request) (Rate_category, bool){
+    category, ok:=r.Context().Value(rate_category_context_key{}).(Rate_category)
+    return category, ok
+}
+
+// The user an api key acts for, if any
+func api_key_user(key *Api_key) string{
+    if key.Scope==scope_admin{
+        return "admin"
+    }
+    return key.User
+}
+
+// Limits reads and writes by address and api key, and by user for keys that act for one.
+// Users who give a password are only counted once it was checked (see authenticate), so
+// nobody can use up someone else's requests by sending their name. Auth attempts are
+// limited there too.
+func (l *Rate_limiter) wrap(mux *http.ServeMux, handler http.Handler) http.Handler{
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        if l==nil{
+            handler.ServeHTTP(w, r)
+            return
+        }
+        category:=rate_category_of(mux, r)
+
+        clients:=[]string{"address "+remote_host(r)}
+        if key:=api_key_from_request(r);key!=nil{
+            clients=append(clients, "api_key "+key.Id)
+            if user:=api_key_user(key);user!=""{
+                clients=append(clients, "user "+user)
+            }
+        }
+
+        wait:=l.take(category, clients...)
+        if wait>0{
+            w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+            http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+            return
+        }
+        handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), rate_category_context_key{}, category)))
+    })
+}
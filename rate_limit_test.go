@@ -0,0 +1,146 @@
+package main;
+
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "strings"
+import "testing"
+import "time"
+
+func TestToken_bucket(t *testing.T){
+    now:=time.Now()
+    bucket:=new_token_bucket(1, 2, now)
+
+    // The burst first
+    for i:=0; i<2; i++{
+        if ok,_:=bucket.take(now); !ok{
+            t.Error()
+        }
+    }
+    ok, wait:=bucket.take(now)
+    if ok || wait!=time.Second{
+        t.Error(wait)
+    }
+
+    // Then one per second
+    if ok,_:=bucket.take(now.Add(time.Second)); !ok{
+        t.Error()
+    }
+    if ok,_:=bucket.take(now.Add(time.Second)); ok{
+        t.Error()
+    }
+
+    // Unused tokens do not add up beyond the burst
+    for i:=0; i<3; i++{
+        ok, _=bucket.take(now.Add(time.Hour))
+        if ok!=(i<2){
+            t.Error(i)
+        }
+    }
+}
+
+func TestRate_limiter(t *testing.T){
+    config:=default_config()
+    config.Rate_limit_reads_per_minute=0
+    config.Rate_limit_writes_per_minute=2
+    limiter:=new_rate_limiter(config)
+    now:=time.Now()
+    limiter.now=func() time.Time{return now}
+
+    // No limit
+    for i:=0; i<100; i++{
+        if limiter.take(rate_read, "address a")!=0{
+            t.Error()
+        }
+    }
+
+    if limiter.take(rate_write, "address a", "api_key k")!=0 || limiter.take(rate_write, "address a")!=0{
+        t.Error()
+    }
+    if limiter.take(rate_write, "address a")!=30*time.Second{
+        t.Error()
+    }
+    // A client without tokens keeps the others from losing theirs
+    if limiter.take(rate_write, "address a", "api_key k")==0{
+        t.Error()
+    }
+    if limiter.take(rate_write, "api_key k")!=0{
+        t.Error()
+    }
+    // Categories are counted separately
+    if limiter.take(rate_auth, "address a")!=0{
+        t.Error()
+    }
+
+    // Full buckets are forgotten
+    now=now.Add(time.Hour)
+    limiter.take(rate_auth, "address b")
+    if len(limiter.buckets)!=1{
+        t.Error(len(limiter.buckets))
+    }
+
+    var nil_limiter *Rate_limiter
+    if nil_limiter.take(rate_write, "address a")!=0{
+        t.Error()
+    }
+}
+
+func TestRate_limiterWrap(t *testing.T){
+    config:=default_config()
+    config.Rate_limit_reads_per_minute=2
+    config.Rate_limit_writes_per_minute=1
+    limiter:=new_rate_limiter(config)
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_user(Actor{}, "b", "password")
+    users.rate_limiter=limiter
+
+    mux:=http.NewServeMux()
+    ok:=func(w http.ResponseWriter, r *http.Request){}
+    mux.HandleFunc("/get_entries", ok)
+    mux.HandleFunc("/add_entry", func(w http.ResponseWriter, r *http.Request){
+        err:=users.authenticate(r, r.FormValue("name"), r.FormValue("password"))
+        if err!=nil{
+            http_login_error(w, err)
+        }
+    })
+    handler:=limiter.wrap(mux, mux)
+
+    post:=func(path, address, name, password string) *httptest.ResponseRecorder{
+        form:=url.Values{"name": {name}, "password": {password}}
+        r:=httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        r.RemoteAddr=address
+        w:=httptest.NewRecorder()
+        handler.ServeHTTP(w, r)
+        return w
+    }
+
+    if post("/add_entry", "1.2.3.4:1000", "a", "password").Code!=http.StatusOK{
+        t.Error()
+    }
+    // Other ports of the same address count too
+    w:=post("/add_entry", "1.2.3.4:1001", "b", "password")
+    if w.Code!=http.StatusTooManyRequests || w.Header().Get("Retry-After")==""{
+        t.Error(w.Code, w.Header().Get("Retry-After"))
+    }
+    // So does the same user from another address
+    if post("/add_entry", "5.6.7.8:1000", "a", "password").Code!=http.StatusTooManyRequests{
+        t.Error()
+    }
+    // But only once they are authenticated, others cannot use up their requests
+    if post("/add_entry", "9.9.9.9:1000", "b", "wrong").Code!=http.StatusUnauthorized{
+        t.Error()
+    }
+    if post("/add_entry", "8.8.8.8:1000", "b", "password").Code!=http.StatusOK{
+        t.Error()
+    }
+
+    // The frontend posts to /get_entries, which is a read
+    if post("/get_entries", "1.2.3.4:1000", "", "").Code!=http.StatusOK || post("/get_entries", "1.2.3.4:1000", "", "").Code!=http.StatusOK{
+        t.Error()
+    }
+    if post("/get_entries", "1.2.3.4:1000", "", "").Code!=http.StatusTooManyRequests{
+        t.Error()
+    }
+}
@@ -0,0 +1,254 @@
+package main;
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "path/filepath"
+import "strconv"
+import "strings"
+import "time"
+
+// Says which fields of a report somebody may see
+type Role string
+
+const(
+    role_admin Role="admin"
+    // For displays and similar: who booked is hidden, only how much was booked
+    role_viewer Role="viewer"
+)
+
+// A user as shown in reports. Passwords are never part of it.
+type Report_user struct{
+    Name string `json:"name,omitempty"`
+    Disabled *bool `json:"disabled,omitempty"`
+    Entries []Entry `json:"entries,omitempty"`
+    Entry_count int `json:"entry_count"`
+}
+
+type Report_filter struct{
+    // Users whose name contains this
+    Name string
+    // "", "yes" or "no"
+    Disabled string
+    // Only entries of these days are included (zero means no limit, both inclusive)
+    From Entry
+    Until Entry
+    // Starts at 1
+    Page int
+    Per_page int
+}
+
+const default_report_page_size=50
+const max_report_page_size=500
+
+// Removes the fields the role may not see
+func redact_report_user(user Report_user, role Role) Report_user{
+    switch role{
+    case role_admin:
+        return user
+    case role_viewer:
+        return Report_user{Entry_count: user.Entry_count}
+    }
+    return Report_user{}
+}
+
+func entry_in_range(entry Entry, from Entry, until Entry) bool{
+    day:=entry
+    day.Slot=0
+    if from!=(Entry{}) && day.Before(from){
+        return false
+    }
+    if until!=(Entry{}) && until.Before(day){
+        return false
+    }
+    return true
+}
+
+// Returns a page of users matching the filter, redacted for the role, and how many
+// users match in total
+func (u *Users) get_report(filter Report_filter, role Role) ([]Report_user, int){
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    matching:=[]Report_user{}
+    for _,user:=range u.users{
+        if !strings.Contains(user.Name, filter.Name){
+            continue
+        }
+        if (filter.Disabled=="yes" && !user.Disabled) || (filter.Disabled=="no" && user.Disabled){
+            continue
+        }
+
+        entries:=[]Entry{}
+        for _,entry:=range user.Entries{
+            if entry_in_range(entry, filter.From, filter.Until){
+                entries=append(entries, entry)
+            }
+        }
+        disabled:=user.Disabled
+        matching=append(matching, Report_user{user.Name, &disabled, entries, len(entries)})
+    }
+
+    start:=(filter.Page-1)*filter.Per_page
+    if start>len(matching){
+        start=len(matching)
+    }
+    end:=start+filter.Per_page
+    if end>len(matching){
+        end=len(matching)
+    }
+
+    page:=[]Report_user{}
+    for _,user:=range matching[start:end]{
+        page=append(page, redact_report_user(user, role))
+    }
+    return page, len(matching)
+}
+
+// Parses a date like 2017-05-03 into an entry with slot 0, an empty string gives a zero entry
+func parse_day(value string) (Entry, error){
+    if value==""{
+        return Entry{}, nil
+    }
+
+    day, err:=time.Parse("2006-01-02", value)
+    if err!=nil{
+        return Entry{}, fmt.Errorf("%q is not a date like 2017-05-03", value)
+    }
+    year, month, day_of_month:=day.Date()
+    return Entry{year, int(month), day_of_month, 0}, nil
+}
+
+// Reads a report filter from form values
+func parse_report_filter(r *http.Request) (Report_filter, error){
+    var err error
+    filter:=Report_filter{Name: r.FormValue("name"), Disabled: r.FormValue("disabled"), Page: 1, Per_page: default_report_page_size}
+    if filter.Disabled!="" && filter.Disabled!="yes" && filter.Disabled!="no"{
+        return filter, fmt.Errorf("disabled must be yes or no")
+    }
+
+    filter.From, err=parse_day(r.FormValue("from"))
+    if err!=nil{
+        return filter, err
+    }
+    filter.Until, err=parse_day(r.FormValue("until"))
+    if err!=nil{
+        return filter, err
+    }
+
+    if r.FormValue("page")!=""{
+        filter.Page, err=strconv.Atoi(r.FormValue("page"))
+        if err!=nil || filter.Page<1{
+            return filter, fmt.Errorf("page must be a positive number")
+        }
+    }
+    if r.FormValue("per_page")!=""{
+        filter.Per_page, err=strconv.Atoi(r.FormValue("per_page"))
+        if err!=nil || filter.Per_page<1 || filter.Per_page>max_report_page_size{
+            return filter, fmt.Errorf("per_page must be between 1 and %d", max_report_page_size)
+        }
+    }
+
+    return filter, nil
+}
+
+// Shows users and their entries (but no passwords) to the admin. Expects a form POST
+// with admin_password and optionally name, disabled, from, until, page and per_page.
+func (u *Users) http_see_all(w http.ResponseWriter, r *http.Request){
+    var to_send struct{
+        Total int `json:"total"`
+        Page int `json:"page"`
+        Per_page int `json:"per_page"`
+        Users []Report_user `json:"users"`
+    }
+
+    if r.Method=="GET"{
+        w.Header().Set("Content-Type", "text/html")
+        http.ServeFile(w, r, filepath.Join(u.config.Frontend_dir, "see_all.html"))
+        return
+    }
+
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be GET or POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Read keys (of displays and the like) see how much was booked, but not by whom
+    role:=role_admin
+    actor:="admin"
+    if key:=api_key_from_request(r);key!=nil && key.Scope==scope_read{
+        role=role_viewer
+        actor="api_key "+key.Id
+    } else{
+        // Get form data
+        admin_password:=r.FormValue("admin_password")
+        err:=u.authenticate(r, "admin", admin_password)
+
+        // If the enetered password is not the admin's
+        if err!=nil{
+            http_login_error(w, err)
+            return
+        }
+    }
+
+    filter, err:=parse_report_filter(r)
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    to_send.Users, to_send.Total=u.get_report(filter, role)
+    to_send.Page=filter.Page
+    to_send.Per_page=filter.Per_page
+    u.audit(r, actor, "see_all", "", "", "")
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&to_send)
+}
+
+// What has to be typed to confirm an export including every password
+const raw_export_confirmation="export passwords"
+
+// Sends the whole data file, passwords included. Expects a form POST with admin_password
+// and confirm set to raw_export_confirmation.
+func (u *Users) http_export_raw(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // The passwords are not handed to keys
+    if api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    if r.FormValue("confirm")!=raw_export_confirmation{
+        http.Error(w, fmt.Sprintf("The export includes every password, type %q to confirm", raw_export_confirmation), http.StatusBadRequest)
+        return
+    }
+
+    // Get all data (including all passwords) in readable json format
+    json_users,err:=u.as_json()
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    fmt.Println("Raw data exported")
+    u.audit(r, "admin", "export_raw", "", "", "")
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Disposition", "attachment; filename=\"users.json\"")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write(json_users)
+}
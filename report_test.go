@@ -0,0 +1,97 @@
+package main;
+
+import "context"
+import "testing"
+import "net/http/httptest"
+import "strings"
+
+func TestUsersGet_report(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "101", "p")
+    users.add_user(Actor{}, "102", "p")
+    users.add_user(Actor{}, "201", "p")
+    users.set_user_disabled(Actor{}, "102", true)
+    users.add_entry(Actor{}, "101", Entry{2017,5,2,4})
+    users.add_entry(Actor{}, "101", Entry{2017,5,3,4})
+    users.add_entry(Actor{}, "101", Entry{2017,5,4,4})
+
+    report, total:=users.get_report(Report_filter{Page: 1, Per_page: 50}, role_admin)
+    if total!=3 || len(report)!=3 || report[0].Name!="101" || report[0].Entry_count!=3 || *report[1].Disabled!=true{
+        t.Error()
+    }
+
+    report, total=users.get_report(Report_filter{Name: "10", Disabled: "no", From: Entry{2017,5,3,0}, Until: Entry{2017,5,3,0}, Page: 1, Per_page: 50}, role_admin)
+    if total!=1 || len(report)!=1 || len(report[0].Entries)!=1 || !report[0].Entries[0].Equals(Entry{2017,5,3,4}){
+        t.Error()
+    }
+
+    // Pages
+    report, total=users.get_report(Report_filter{Page: 2, Per_page: 2}, role_admin)
+    if total!=3 || len(report)!=1 || report[0].Name!="201"{
+        t.Error()
+    }
+    report, _=users.get_report(Report_filter{Page: 3, Per_page: 2}, role_admin)
+    if len(report)!=0{
+        t.Error()
+    }
+
+    // Viewers only see counts
+    report, _=users.get_report(Report_filter{Page: 1, Per_page: 1}, role_viewer)
+    if report[0].Name!="" || report[0].Disabled!=nil || report[0].Entries!=nil || report[0].Entry_count!=3{
+        t.Error()
+    }
+}
+
+func TestParse_report_filter(t *testing.T){
+    r:=httptest.NewRequest("POST", "/see_all", strings.NewReader("name=1&from=2017-05-03&page=2&per_page=10"))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    filter, err:=parse_report_filter(r)
+    if err!=nil || filter.Name!="1" || filter.From!=(Entry{2017,5,3,0}) || filter.Until!=(Entry{}) || filter.Page!=2 || filter.Per_page!=10{
+        t.Error()
+    }
+
+    for _,body:=range []string{"from=3.5.2017", "page=0", "per_page=1000", "disabled=maybe"}{
+        r=httptest.NewRequest("POST", "/see_all", strings.NewReader(body))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        _, err=parse_report_filter(r)
+        if err==nil{
+            t.Error(body)
+        }
+    }
+}
+
+func TestUsersHttp_see_allRole(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "admin", "password")
+    users.add_user(Actor{}, "101", "p")
+    users.add_entry(Actor{}, "101", Entry{2017,2,3,4})
+
+    post:=func(key *Api_key, admin_password string) (int, string){
+        r:=httptest.NewRequest("POST", "/see_all", strings.NewReader("admin_password="+admin_password))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        if key!=nil{
+            r=r.WithContext(context.WithValue(r.Context(), api_key_context_key{}, key))
+        }
+        w:=httptest.NewRecorder()
+        users.http_see_all(w, r)
+        return w.Code, w.Body.String()
+    }
+
+    code, body:=post(nil, "password")
+    if code!=200 || !strings.Contains(body, `"name":"101"`){
+        t.Error(code, body)
+    }
+    if code,_:=post(nil, "wrong"); code!=401{
+        t.Error(code)
+    }
+
+    // Read keys get counts without names
+    code, body=post(&Api_key{Id: "k", Scope: scope_read}, "")
+    if code!=200 || strings.Contains(body, "101") || !strings.Contains(body, `"entry_count":1`){
+        t.Error(code, body)
+    }
+    // Book keys get nothing
+    if code,_:=post(&Api_key{Id: "k", Scope: scope_book, User: "101"}, ""); code!=403{
+        t.Error(code)
+    }
+}
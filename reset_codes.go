@@ -0,0 +1,250 @@
+package main;
+
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "time"
+
+// Characters reset codes are made of, without those that are easily confused (0 O 1 I)
+const reset_code_characters="ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+const reset_code_length=12
+
+var error_unknown_reset_code=errors.New("The code is not valid (it may have expired or been used already)")
+
+// A code that lets a user set a new password once. Only a hash of the code is kept.
+type Reset_code struct{
+    Name string
+    Hash string
+    Expires time.Time
+}
+
+// The reset codes the admin handed out that were not used yet, kept in a file
+type Reset_codes struct{
+    users *Users
+    filename string
+    valid_for time.Duration
+    lock *sync.Mutex
+    codes []Reset_code
+}
+
+// Loads the codes from a file, a missing file means there are none yet
+func new_reset_codes(users *Users, filename string, valid_for time.Duration) (*Reset_codes, error){
+    codes:=[]Reset_code{}
+    content, err:=ioutil.ReadFile(filename)
+    if err==nil{
+        err=json.Unmarshal(content, &codes)
+        if err!=nil{
+            return nil, err
+        }
+    } else if !os.IsNotExist(err){
+        return nil, err
+    }
+
+    return &Reset_codes{users, filename, valid_for, &sync.Mutex{}, codes}, nil
+}
+
+// Upper case without separators, so codes can be typed in any way
+func normalize_reset_code(code string) string{
+    code=strings.ToUpper(code)
+    code=strings.Replace(code, "-", "", -1)
+    code=strings.Replace(code, " ", "", -1)
+    return code
+}
+
+func hash_reset_code(code string) string{
+    hash:=sha256.Sum256([]byte(normalize_reset_code(code)))
+    return hex.EncodeToString(hash[:])
+}
+
+// Must be called with the lock held. Expired codes are dropped on the way.
+func (c *Reset_codes) save(now time.Time) error{
+    codes:=[]Reset_code{}
+    for _,code:=range c.codes{
+        if now.Before(code.Expires){
+            codes=append(codes, code)
+        }
+    }
+    c.codes=codes
+
+    b, err:=json.Marshal(c.codes)
+    if err!=nil{
+        return err
+    }
+    return ioutil.WriteFile(c.filename, b, 0600)
+}
+
+// Creates a code for a user, replacing any code the user had. The code is grouped like
+// ABCD-EFGH-JKLM to be read out easily.
+func (c *Reset_codes) issue(name string, now time.Time) (string, time.Time, error){
+    _, err:=c.users.get_users_password(name)
+    if err!=nil{
+        return "", time.Time{}, err
+    }
+
+    code, err:=random_string([]rune(reset_code_characters), reset_code_length)
+    if err!=nil{
+        return "", time.Time{}, err
+    }
+    code=code[0:4]+"-"+code[4:8]+"-"+code[8:12]
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    codes:=[]Reset_code{}
+    for _,old_code:=range c.codes{
+        if old_code.Name!=name{
+            codes=append(codes, old_code)
+        }
+    }
+    expires:=now.Add(c.valid_for)
+    c.codes=append(codes, Reset_code{name, hash_reset_code(code), expires})
+    err=c.save(now)
+    if err!=nil{
+        return "", time.Time{}, err
+    }
+    return code, expires, nil
+}
+
+// Sets the password of the code's user. The code can only be used once, but if the new
+// password is refused it stays valid. The request (which may be nil) is audited as coming
+// from the user.
+func (c *Reset_codes) redeem(r *http.Request, code string, new_password string, now time.Time) (string, error){
+    hash:=hash_reset_code(code)
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    for i,reset_code:=range c.codes{
+        if reset_code.Hash!=hash || !now.Before(reset_code.Expires){
+            continue
+        }
+
+        // Disabled users stay locked out
+        _, err:=c.users.get_users_password(reset_code.Name)
+        if err==nil{
+            err=c.users.reset_password(Actor{reset_code.Name, r}, reset_code.Name, new_password)
+        }
+        if err!=nil{
+            return "", err
+        }
+
+        c.codes=append(c.codes[:i], c.codes[i+1:]...)
+        err=c.save(now)
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, "Could not save reset codes:", err)
+        }
+        return reset_code.Name, nil
+    }
+
+    return "", error_unknown_reset_code
+}
+
+// Lets the admin create a reset code for a user. Expects a form POST with admin_password
+// and name, answers with the code.
+func (c *Reset_codes) http_issue_reset_code(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    name:=r.FormValue("name")
+    err:=c.users.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    // A code sets a password, which keys are not allowed to do
+    if api_key_from_request(r)!=nil{
+        http_login_error(w, error_api_key_scope)
+        return
+    }
+
+    if name=="admin"{
+        http.Error(w, "The admin user cannot be changed this way", http.StatusBadRequest)
+        return
+    }
+
+    code, expires, err:=c.issue(name, time.Now())
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    fmt.Println("Reset code issued:", name)
+    c.users.audit(r, "admin", "issue_reset_code", name, "", expires.Format(time.RFC3339))
+
+    // The message contains user supplied names, so it is not sent as html
+    w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write([]byte(fmt.Sprintf("Reset code for %s: %s (valid until %s)", name, code, expires.Format("2006-01-02 15:04"))))
+}
+
+// Lets a user set a new password with a reset code. Expects a form POST with code,
+// new_password1 and new_password2.
+func (c *Reset_codes) http_redeem_reset_code(w http.ResponseWriter, r *http.Request){
+    if r.Method=="GET"{
+        w.Header().Set("Content-Type", "text/html")
+        http.ServeFile(w, r, filepath.Join(c.users.config.Frontend_dir, "redeem_reset_code.html"))
+        return
+    }
+
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be GET or POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    code:=r.FormValue("code")
+    new_password1:=r.FormValue("new_password1")
+    new_password2:=r.FormValue("new_password2")
+
+    // If the new password and the new password re-entry are inconsistent
+    if new_password1!=new_password2{
+        http.Error(w, "Must entry the same password in both \"New Password\" fields", http.StatusBadRequest)
+        return
+    }
+
+    // Codes are guessed like passwords, so the same limits apply
+    address:=remote_host(r)
+    wait:=c.users.login_guard.address_wait(address)
+    if wait>0{
+        http_login_error(w, &Login_blocked_error{wait, false})
+        return
+    }
+
+    name, err:=c.redeem(r, code, new_password1, time.Now())
+    if err==error_unknown_reset_code{
+        c.users.metrics.failed_login("unknown_reset_code")
+    }
+    if err==error_unknown_reset_code && c.users.login_guard.address_failed(address){
+        fmt.Println("Address locked out:", address)
+        c.users.audit(r, "", "lockout_address", address, "", c.users.login_guard.lockout.String())
+    }
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    // Save changes to file
+    err=c.users.to_file(c.users.config.Data_file)
+    if err!=nil{
+        fmt.Fprintln(os.Stderr, err)
+    }
+    c.users.login_guard.unlock(name)
+    fmt.Println("Password reset with a code:", name)
+
+    w.Header().Set("Content-Type", "text/html")
+    w.Write([]byte("Password changed successfully"))
+}
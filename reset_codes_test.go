@@ -0,0 +1,115 @@
+package main;
+
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+func TestReset_codes(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_user(Actor{}, "b", "password")
+    users.set_user_disabled(Actor{}, "b", true)
+
+    codes, err:=new_reset_codes(&users, "DELETEME.json", time.Hour)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    now:=time.Now()
+    if _,_,err:=codes.issue("nobody", now); err==nil{
+        t.Error()
+    }
+    if _,_,err:=codes.issue("b", now); err==nil{
+        t.Error()
+    }
+
+    first, _, err:=codes.issue("a", now)
+    if err!=nil || len(first)!=14{
+        t.Error(first, err)
+    }
+    // A new code replaces the old one
+    code, expires, err:=codes.issue("a", now)
+    if err!=nil || !expires.Equal(now.Add(time.Hour)){
+        t.Error()
+    }
+    if _,err:=codes.redeem(nil, first, "new password", now); err!=error_unknown_reset_code{
+        t.Error(err)
+    }
+
+    // Codes are kept in the file and are only hashes there
+    codes, err=new_reset_codes(&users, "DELETEME.json", time.Hour)
+    if err!=nil || len(codes.codes)!=1 || codes.codes[0].Hash==code{
+        t.Error()
+    }
+
+    // Expired codes cannot be used
+    if _,err:=codes.redeem(nil, code, "new password", now.Add(2*time.Hour)); err!=error_unknown_reset_code{
+        t.Error(err)
+    }
+    // Refused passwords leave the code valid
+    if _,err:=codes.redeem(nil, code, "", now); err==nil || err==error_unknown_reset_code{
+        t.Error(err)
+    }
+    name, err:=codes.redeem(nil, strings.ToLower(strings.Replace(code, "-", "", -1)), "new password", now)
+    if err!=nil || name!="a"{
+        t.Error(err)
+    }
+    password, _:=users.get_users_password("a")
+    if password!="new password"{
+        t.Error()
+    }
+    // Only once
+    if _,err:=codes.redeem(nil, code, "another password", now); err!=error_unknown_reset_code{
+        t.Error(err)
+    }
+
+    err=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
+
+func TestReset_codesHttp_redeem_reset_code(t *testing.T){
+    users:=new_users()
+    users.config.Data_file="DELETEME.users.json"
+    users.add_user(Actor{}, "a", "password")
+    codes, _:=new_reset_codes(&users, "DELETEME.json", time.Hour)
+    code, _, _:=codes.issue("a", time.Now())
+
+    post:=func(code, password1, password2 string) int{
+        form:=url.Values{"code": {code}, "new_password1": {password1}, "new_password2": {password2}}
+        r:=httptest.NewRequest("POST", "/redeem_reset_code", strings.NewReader(form.Encode()))
+        r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+        w:=httptest.NewRecorder()
+        codes.http_redeem_reset_code(w, r)
+        return w.Code
+    }
+
+    if post(code, "new password", "other password")!=400{
+        t.Error()
+    }
+    if post(code, "new password", "new password")!=200{
+        t.Error()
+    }
+
+    // Guessing codes gets blocked
+    for i:=0; i<users.config.Login_free_attempts+1; i++{
+        if post("AAAA-AAAA-AAAA", "new password", "new password")!=400{
+            t.Error()
+        }
+    }
+    if post("AAAA-AAAA-AAAA", "new password", "new password")!=429{
+        t.Error()
+    }
+
+    err:=os.Remove("DELETEME.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+    err=os.Remove("DELETEME.users.json")
+    if err!=nil{
+        panic("Could not remove temporary file")
+    }
+}
@@ -0,0 +1,156 @@
+package main;
+
+import "errors"
+import "fmt"
+import "strings"
+import "sync"
+import "time"
+
+// Returns when a job should run next, given the current time
+type Schedule func(now time.Time) time.Time
+
+// Parses a cadence like "daily 03:00" (every day at that local time) or a duration like
+// "6h" (that long after the previous run). An empty string or "off" gives a nil schedule.
+func parse_schedule(value string) (Schedule, error){
+    value=strings.TrimSpace(value)
+    if value=="" || value=="off"{
+        return nil, nil
+    }
+
+    if strings.HasPrefix(value, "daily "){
+        at, err:=time.Parse("15:04", strings.TrimSpace(strings.TrimPrefix(value, "daily ")))
+        if err!=nil{
+            return nil, fmt.Errorf("%q is not like \"daily 03:00\"", value)
+        }
+        return func(now time.Time) time.Time{
+            year, month, day:=now.Date()
+            next:=time.Date(year, month, day, at.Hour(), at.Minute(), 0, 0, now.Location())
+            if !next.After(now){
+                next=time.Date(year, month, day+1, at.Hour(), at.Minute(), 0, 0, now.Location())
+            }
+            return next
+        }, nil
+    }
+
+    interval, err:=time.ParseDuration(value)
+    if err!=nil || interval<time.Second{
+        return nil, fmt.Errorf("%q is neither like \"daily 03:00\" nor a duration like \"6h\"", value)
+    }
+    return func(now time.Time) time.Time{
+        return now.Add(interval)
+    }, nil
+}
+
+// What is known about a job, for status pages
+type Job_status struct{
+    Name string `json:"name"`
+    Running bool `json:"running"`
+    Next_run time.Time `json:"next_run"`
+    Last_run time.Time `json:"last_run,omitempty"`
+    Last_error string `json:"last_error,omitempty"`
+}
+
+type Job struct{
+    schedule Schedule
+    run func() error
+    status Job_status
+}
+
+// Runs jobs in the background, each one on its own schedule. A job never runs twice at
+// the same time.
+type Scheduler struct{
+    lock *sync.Mutex
+    jobs []*Job
+    started bool
+    stop_channel chan struct{}
+    running *sync.WaitGroup
+}
+
+func new_scheduler() *Scheduler{
+    return &Scheduler{&sync.Mutex{}, []*Job{}, false, make(chan struct{}), &sync.WaitGroup{}}
+}
+
+// Jobs have to be added before the scheduler is started
+func (s *Scheduler) add(name string, schedule Schedule, run func() error) error{
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if s.started{
+        return errors.New("Jobs cannot be added to a running scheduler")
+    }
+    if schedule==nil{
+        return errors.New("A job needs a schedule")
+    }
+    s.jobs=append(s.jobs, &Job{schedule, run, Job_status{Name: name}})
+    return nil
+}
+
+func (s *Scheduler) start(){
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    if s.started{
+        return
+    }
+    s.started=true
+    for _,job:=range s.jobs{
+        s.running.Add(1)
+        go s.loop(job)
+    }
+}
+
+func (s *Scheduler) loop(job *Job){
+    defer s.running.Done()
+    for{
+        next:=job.schedule(time.Now())
+        s.lock.Lock()
+        job.status.Next_run=next
+        s.lock.Unlock()
+
+        timer:=time.NewTimer(time.Until(next))
+        select{
+        case <-s.stop_channel:
+            timer.Stop()
+            return
+        case <-timer.C:
+        }
+
+        s.lock.Lock()
+        job.status.Running=true
+        s.lock.Unlock()
+
+        err:=job.run()
+
+        s.lock.Lock()
+        job.status.Running=false
+        job.status.Last_run=time.Now()
+        job.status.Last_error=""
+        if err!=nil{
+            job.status.Last_error=err.Error()
+        }
+        s.lock.Unlock()
+    }
+}
+
+// Waits for running jobs to finish and keeps any other from starting
+func (s *Scheduler) stop(){
+    s.lock.Lock()
+    select{
+    case <-s.stop_channel:
+    default:
+        close(s.stop_channel)
+    }
+    s.lock.Unlock()
+    s.running.Wait()
+}
+
+func (s *Scheduler) status() []Job_status{
+    s.lock.Lock()
+    defer s.lock.Unlock()
+
+    statuses:=[]Job_status{}
+    for _,job:=range s.jobs{
+        statuses=append(statuses, job.status)
+    }
+    return statuses
+}
@@ -0,0 +1,82 @@
+package main;
+
+import "errors"
+import "testing"
+import "time"
+
+func TestParse_schedule(t *testing.T){
+    schedule, err:=parse_schedule("")
+    if err!=nil || schedule!=nil{
+        t.Error()
+    }
+    schedule, err=parse_schedule("off")
+    if err!=nil || schedule!=nil{
+        t.Error()
+    }
+
+    schedule, err=parse_schedule("daily 03:00")
+    if err!=nil || schedule==nil{
+        t.Fatal(err)
+    }
+    now:=time.Date(2017, 5, 3, 2, 0, 0, 0, time.Local)
+    if schedule(now)!=time.Date(2017, 5, 3, 3, 0, 0, 0, time.Local){
+        t.Error(schedule(now))
+    }
+    now=time.Date(2017, 5, 3, 3, 0, 0, 0, time.Local)
+    if schedule(now)!=time.Date(2017, 5, 4, 3, 0, 0, 0, time.Local){
+        t.Error(schedule(now))
+    }
+
+    schedule, err=parse_schedule("6h")
+    if err!=nil || schedule(now)!=now.Add(6*time.Hour){
+        t.Error()
+    }
+
+    for _,value:=range []string{"daily", "daily 25:00", "nightly", "1ms", "-1h"}{
+        _, err=parse_schedule(value)
+        if err==nil{
+            t.Error(value)
+        }
+    }
+}
+
+func TestScheduler(t *testing.T){
+    scheduler:=new_scheduler()
+    if scheduler.add("none", nil, func() error{ return nil })==nil{
+        t.Error()
+    }
+
+    runs:=make(chan bool, 10)
+    every_second, _:=parse_schedule("1s")
+    scheduler.add("job", every_second, func() error{
+        runs<-true
+        return errors.New("failed")
+    })
+    scheduler.start()
+    if scheduler.add("late", every_second, func() error{ return nil })==nil{
+        t.Error()
+    }
+
+    select{
+    case <-runs:
+    case <-time.After(5*time.Second):
+        t.Fatal("The job did not run")
+    }
+    scheduler.stop()
+    // Stopping twice does nothing
+    scheduler.stop()
+
+    status:=scheduler.status()
+    if len(status)!=1 || status[0].Name!="job" || status[0].Running || status[0].Last_run.IsZero() || status[0].Last_error!="failed"{
+        t.Error(status)
+    }
+
+    // No run after stopping
+    for len(runs)>0{
+        <-runs
+    }
+    time.Sleep(1500*time.Millisecond)
+    if len(runs)!=0{
+        t.Error()
+    }
+}
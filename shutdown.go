@@ -0,0 +1,54 @@
+package main;
+
+import "context"
+import "fmt"
+import "net/http"
+import "os"
+import "sync"
+import "time"
+
+// How long running requests get to finish when the server shuts down
+const shutdown_timeout=20*time.Second
+
+// Stops the servers from accepting requests and lets the running ones finish (cutting off
+// those that take longer than the timeout), then stops the background jobs and saves what
+// is only kept in memory. Returns the first thing that went wrong.
+func shut_down(timeout time.Duration, servers []*http.Server, scheduler *Scheduler, flushes []func() error) error{
+    var first_error error
+    note:=func(err error){
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, err)
+            if first_error==nil{
+                first_error=err
+            }
+        }
+    }
+
+    ctx, cancel:=context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    shutdown_errors:=make([]error, len(servers))
+    var wait_group sync.WaitGroup
+    for i,server:=range servers{
+        wait_group.Add(1)
+        go func(i int, server *http.Server){
+            defer wait_group.Done()
+            err:=server.Shutdown(ctx)
+            if err!=nil{
+                server.Close()
+                shutdown_errors[i]=fmt.Errorf("Requests on %s were cut off: %s", server.Addr, err)
+            }
+        }(i, server)
+    }
+    wait_group.Wait()
+    for _,err:=range shutdown_errors{
+        note(err)
+    }
+
+    // Running jobs are waited for, no new ones start
+    scheduler.stop()
+
+    for _,flush:=range flushes{
+        note(flush())
+    }
+    return first_error
+}
@@ -0,0 +1,74 @@
+package main;
+
+import "errors"
+import "net"
+import "net/http"
+import "testing"
+import "time"
+
+// Starts a server whose requests take the given time, returns it and its address
+func start_slow_server(t *testing.T, duration time.Duration) (*http.Server, string){
+    listener, err:=net.Listen("tcp", "127.0.0.1:0")
+    if err!=nil{
+        t.Fatal(err)
+    }
+    server:=&http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        time.Sleep(duration)
+        w.Write([]byte("done"))
+    })}
+    go server.Serve(listener)
+    return server, listener.Addr().String()
+}
+
+func TestShut_down(t *testing.T){
+    server, address:=start_slow_server(t, 100*time.Millisecond)
+    answered:=make(chan bool)
+    go func(){
+        response, err:=http.Get("http://"+address+"/")
+        if err==nil{
+            response.Body.Close()
+        }
+        answered<-err==nil && response.StatusCode==http.StatusOK
+    }()
+    time.Sleep(20*time.Millisecond)
+
+    scheduler:=new_scheduler()
+    scheduler.start()
+    flushed:=0
+    flush:=func() error{
+        flushed++
+        return nil
+    }
+
+    // The running request gets to finish, then everything is saved
+    err:=shut_down(time.Second, []*http.Server{server}, scheduler, []func() error{flush, flush})
+    if err!=nil || !<-answered || flushed!=2{
+        t.Error(err)
+    }
+    // No new requests are accepted
+    if _,err:=http.Get("http://"+address+"/"); err==nil{
+        t.Error()
+    }
+}
+
+func TestShut_downErrors(t *testing.T){
+    server, address:=start_slow_server(t, time.Second)
+    go http.Get("http://"+address+"/")
+    time.Sleep(20*time.Millisecond)
+
+    // Requests that take too long are cut off, failed saves are reported, both after
+    // everything else was done
+    flushed:=false
+    failing:=func() error{
+        return errors.New("Could not save")
+    }
+    flush:=func() error{
+        flushed=true
+        return nil
+    }
+    start:=time.Now()
+    err:=shut_down(10*time.Millisecond, []*http.Server{server}, new_scheduler(), []func() error{failing, flush})
+    if err==nil || !flushed || time.Since(start)>500*time.Millisecond{
+        t.Error(err)
+    }
+}
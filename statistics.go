@@ -0,0 +1,215 @@
+package main;
+
+import "encoding/csv"
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "strconv"
+import "time"
+
+// There is only one thing to reserve so far
+const default_resource="laundry"
+
+// Bookings of a key (an hour, a weekday, a resource or a user) compared to what was available
+type Usage struct{
+    Key string `json:"key"`
+    Booked int `json:"booked"`
+    // Slots that could have been booked, 0 if it does not apply (users)
+    Available int `json:"available"`
+    Utilization float64 `json:"utilization"`
+}
+
+type Utilization struct{
+    From string `json:"from"`
+    Until string `json:"until"`
+    Days int `json:"days"`
+    Total Usage `json:"total"`
+    By_hour []Usage `json:"by_hour"`
+    By_weekday []Usage `json:"by_weekday"`
+    By_resource []Usage `json:"by_resource"`
+    By_user []Usage `json:"by_user"`
+    // Taken from the audit log, so they are only known while it is kept
+    Cancellations int `json:"cancellations"`
+    Cancellations_by_user []Usage `json:"cancellations_by_user"`
+}
+
+func new_usage(key string, booked int, available int) Usage{
+    usage:=Usage{key, booked, available, 0}
+    if available>0{
+        usage.Utilization=float64(booked)/float64(available)
+    }
+    return usage
+}
+
+// Turns counts per user into usages sorted by how much was booked (most first)
+func usages_by_count(counts map[string]int) []Usage{
+    usages:=[]Usage{}
+    for key,count:=range counts{
+        usages=append(usages, new_usage(key, count, 0))
+    }
+    sort.Slice(usages, func(i, j int) bool{
+        if usages[i].Booked!=usages[j].Booked{
+            return usages[i].Booked>usages[j].Booked
+        }
+        return usages[i].Key<usages[j].Key
+    })
+    return usages
+}
+
+// Computes how much was booked between two days (both inclusive, as entries with slot 0).
+// Cancellations are the remove_entry records of the audit log in that time.
+func compute_utilization(bookings []Booking, audit_records []Audit_record, from Entry, until Entry) Utilization{
+    first_day:=entry_start(from, time.Local)
+    last_day:=entry_start(until, time.Local)
+
+    utilization:=Utilization{From: first_day.Format("2006-01-02"), Until: last_day.Format("2006-01-02")}
+    days_per_weekday:=[7]int{}
+    for day:=first_day; !day.After(last_day); day=day.AddDate(0, 0, 1){
+        utilization.Days++
+        days_per_weekday[day.Weekday()]++
+    }
+
+    booked:=0
+    by_hour:=[24]int{}
+    by_weekday:=[7]int{}
+    by_user:=make(map[string]int)
+    for _,booking:=range bookings{
+        if !entry_in_range(booking.Entry, from, until){
+            continue
+        }
+        booked++
+        by_hour[booking.Entry.Slot]++
+        by_weekday[entry_start(booking.Entry, time.Local).Weekday()]++
+        by_user[booking.Name]++
+    }
+
+    slots:=utilization.Days*24
+    utilization.Total=new_usage("total", booked, slots)
+    for hour:=0; hour<24; hour++{
+        utilization.By_hour=append(utilization.By_hour, new_usage(fmt.Sprintf("%02d:00", hour), by_hour[hour], utilization.Days))
+    }
+    for weekday:=time.Sunday; weekday<=time.Saturday; weekday++{
+        utilization.By_weekday=append(utilization.By_weekday, new_usage(weekday.String(), by_weekday[weekday], 24*days_per_weekday[weekday]))
+    }
+    utilization.By_resource=[]Usage{new_usage(default_resource, booked, slots)}
+    utilization.By_user=usages_by_count(by_user)
+
+    cancellations_by_user:=make(map[string]int)
+    for _,record:=range audit_records{
+        if record.Action!="remove_entry"{
+            continue
+        }
+        year, month, day:=record.Time.Date()
+        if !entry_in_range(Entry{year, int(month), day, 0}, from, until){
+            continue
+        }
+        utilization.Cancellations++
+        cancellations_by_user[record.Target]++
+    }
+    utilization.Cancellations_by_user=usages_by_count(cancellations_by_user)
+
+    return utilization
+}
+
+// Writes one line per usage: dimension, key, booked, available, utilization
+func write_utilization_csv(writer io.Writer, utilization Utilization) error{
+    csv_writer:=csv.NewWriter(writer)
+    csv_writer.Write([]string{"dimension", "key", "booked", "available", "utilization"})
+    write:=func(dimension string, usages []Usage){
+        for _,usage:=range usages{
+            csv_writer.Write([]string{dimension, usage.Key, strconv.Itoa(usage.Booked), strconv.Itoa(usage.Available), strconv.FormatFloat(usage.Utilization, 'f', 4, 64)})
+        }
+    }
+    write("total", []Usage{utilization.Total})
+    write("hour", utilization.By_hour)
+    write("weekday", utilization.By_weekday)
+    write("resource", utilization.By_resource)
+    write("user", utilization.By_user)
+    write("cancellations", utilization.Cancellations_by_user)
+    csv_writer.Flush()
+    return csv_writer.Error()
+}
+
+// Shows how much the slots are used. Expects a form POST with admin_password and optionally
+// from and until (dates like 2017-05-03, by default the last 30 days) and format (json or csv).
+func (u *Users) http_statistics(w http.ResponseWriter, r *http.Request){
+    if r.Method!="POST"{
+        http.Error(w, "Request to this address must be POST.", http.StatusMethodNotAllowed)
+        return
+    }
+
+    // Get form data
+    admin_password:=r.FormValue("admin_password")
+    err:=u.authenticate(r, "admin", admin_password)
+
+    // If the enetered password is not the admin's
+    if err!=nil{
+        http_login_error(w, err)
+        return
+    }
+
+    format:=r.FormValue("format")
+    if format==""{
+        format="json"
+    }
+    if format!="json" && format!="csv"{
+        http.Error(w, "format must be json or csv", http.StatusBadRequest)
+        return
+    }
+
+    until, _:=day_in_the_future(0)
+    from, _:=day_in_the_future(-29)
+    if r.FormValue("from")!=""{
+        from, err=parse_day(r.FormValue("from"))
+    }
+    if err==nil && r.FormValue("until")!=""{
+        until, err=parse_day(r.FormValue("until"))
+    }
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if until.Before(from){
+        http.Error(w, "until cannot be before from", http.StatusBadRequest)
+        return
+    }
+    if entry_start(until, time.Local).Sub(entry_start(from, time.Local))>10*366*24*time.Hour{
+        http.Error(w, "The date range is too long", http.StatusBadRequest)
+        return
+    }
+
+    audit_records:=[]Audit_record{}
+    if u.audit_log!=nil{
+        audit_records, err=u.audit_log.query(Audit_filter{Action: "remove_entry"})
+        if err!=nil{
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    }
+
+    // Past days have mostly been moved to the archive by now
+    bookings:=u.get_bookings()
+    archived, err:=u.archive.query(Archive_filter{From: from, Until: until})
+    if err!=nil{
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    for _,booking:=range archived{
+        bookings=append(bookings, Booking{booking.Name, booking.Entry})
+    }
+
+    utilization:=compute_utilization(bookings, audit_records, from, until)
+    u.audit(r, "admin", "statistics", "", "", "")
+
+    if format=="csv"{
+        w.Header().Set("Content-Type", "text/csv")
+        w.Header().Set("Content-Disposition", "attachment; filename=\"statistics.csv\"")
+        write_utilization_csv(w, utilization)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(&utilization)
+}
@@ -0,0 +1,52 @@
+package main;
+
+import "testing"
+import "bytes"
+import "strings"
+import "time"
+
+func TestCompute_utilization(t *testing.T){
+    // 2017-05-01 is a Monday
+    bookings:=[]Booking{
+        Booking{"a", Entry{2017,5,1,10}},
+        Booking{"a", Entry{2017,5,2,10}},
+        Booking{"b", Entry{2017,5,2,11}},
+        Booking{"b", Entry{2017,5,8,11}},
+    }
+    audit_records:=[]Audit_record{
+        Audit_record{Time: time.Date(2017, 5, 2, 9, 0, 0, 0, time.Local), Actor: "b", Action: "remove_entry", Target: "b"},
+        Audit_record{Time: time.Date(2017, 5, 2, 9, 0, 0, 0, time.Local), Actor: "b", Action: "add_entry", Target: "b"},
+        Audit_record{Time: time.Date(2017, 5, 9, 9, 0, 0, 0, time.Local), Actor: "b", Action: "remove_entry", Target: "b"},
+    }
+
+    utilization:=compute_utilization(bookings, audit_records, Entry{2017,5,1,0}, Entry{2017,5,7,0})
+    if utilization.Days!=7 || utilization.From!="2017-05-01" || utilization.Until!="2017-05-07"{
+        t.Error()
+    }
+
+    if utilization.Total.Booked!=3 || utilization.Total.Available!=7*24{
+        t.Error()
+    }
+
+    if utilization.By_hour[10].Booked!=2 || utilization.By_hour[10].Available!=7 || utilization.By_hour[10].Utilization!=2.0/7{
+        t.Error()
+    }
+
+    if utilization.By_weekday[time.Tuesday].Booked!=2 || utilization.By_weekday[time.Tuesday].Available!=24 || utilization.By_weekday[time.Monday].Booked!=1{
+        t.Error()
+    }
+
+    if len(utilization.By_user)!=2 || utilization.By_user[0].Key!="a" || utilization.By_user[0].Booked!=2{
+        t.Error()
+    }
+
+    if utilization.Cancellations!=1 || utilization.Cancellations_by_user[0].Key!="b"{
+        t.Error()
+    }
+
+    b:=bytes.Buffer{}
+    err:=write_utilization_csv(&b, utilization)
+    if err!=nil || !strings.HasPrefix(b.String(), "dimension,key,booked,available,utilization\ntotal,total,3,168,0.0179\n"){
+        t.Error(b.String())
+    }
+}
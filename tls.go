@@ -0,0 +1,138 @@
+package main;
+
+import "crypto/tls"
+import "fmt"
+import "net"
+import "net/http"
+import "os"
+import "os/signal"
+import "strconv"
+import "sync"
+import "syscall"
+import "time"
+
+// How often the certificate files are checked for changes
+const certificate_check_interval=10*time.Second
+
+// Keeps the server's certificate and loads it again when its files change, so renewed
+// certificates are used without a restart
+type Certificate_loader struct{
+    cert_file string
+    key_file string
+    lock *sync.RWMutex
+    certificate *tls.Certificate
+    // Modification times of the files the certificate was loaded from
+    cert_modified time.Time
+    key_modified time.Time
+}
+
+func new_certificate_loader(cert_file, key_file string) (*Certificate_loader, error){
+    loader:=&Certificate_loader{cert_file: cert_file, key_file: key_file, lock: &sync.RWMutex{}}
+    err:=loader.load()
+    if err!=nil{
+        return nil, err
+    }
+    return loader, nil
+}
+
+func modification_time(filename string) time.Time{
+    info, err:=os.Stat(filename)
+    if err!=nil{
+        return time.Time{}
+    }
+    return info.ModTime()
+}
+
+// Loads the certificate, on error the old one stays in use
+func (c *Certificate_loader) load() error{
+    cert_modified:=modification_time(c.cert_file)
+    key_modified:=modification_time(c.key_file)
+    certificate, err:=tls.LoadX509KeyPair(c.cert_file, c.key_file)
+    if err!=nil{
+        return err
+    }
+
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.certificate=&certificate
+    c.cert_modified=cert_modified
+    c.key_modified=key_modified
+    return nil
+}
+
+// Whether a file changed since the certificate was loaded
+func (c *Certificate_loader) changed() bool{
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return !modification_time(c.cert_file).Equal(c.cert_modified) || !modification_time(c.key_file).Equal(c.key_modified)
+}
+
+// For tls.Config.GetCertificate
+func (c *Certificate_loader) get_certificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error){
+    c.lock.RLock()
+    defer c.lock.RUnlock()
+    return c.certificate, nil
+}
+
+// Loads the certificate again when its files change or on SIGHUP, until stop is closed
+func (c *Certificate_loader) watch(interval time.Duration, stop <-chan struct{}){
+    hangup:=make(chan os.Signal, 1)
+    signal.Notify(hangup, syscall.SIGHUP)
+    defer signal.Stop(hangup)
+    ticker:=time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for{
+        select{
+        case <-stop:
+            return
+        case <-hangup:
+        case <-ticker.C:
+            if !c.changed(){
+                continue
+            }
+        }
+
+        err:=c.load()
+        if err!=nil{
+            fmt.Fprintln(os.Stderr, "Could not reload certificate:", err)
+        } else{
+            fmt.Println("Certificate reloaded")
+        }
+    }
+}
+
+// Tells browsers to only use https for the server from now on
+func hsts(max_age int, handler http.Handler) http.Handler{
+    if max_age==0{
+        return handler
+    }
+    value:="max-age="+strconv.Itoa(max_age)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        if r.TLS!=nil{
+            w.Header().Set("Strict-Transport-Security", value)
+        }
+        handler.ServeHTTP(w, r)
+    })
+}
+
+// Sends http requests to the same place on the https address (like ":8443")
+func https_redirect(https_address string) http.Handler{
+    _, port, _:=net.SplitHostPort(https_address)
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
+        host, _, err:=net.SplitHostPort(r.Host)
+        if err!=nil{
+            host=r.Host
+        }
+        if port!="" && port!="443"{
+            host=net.JoinHostPort(host, port)
+        }
+
+        // Posts are redirected as posts, but should not have been sent without https anyway
+        code:=http.StatusMovedPermanently
+        if r.Method!="GET" && r.Method!="HEAD"{
+            code=http.StatusPermanentRedirect
+        }
+        http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+    })
+}
@@ -0,0 +1,121 @@
+package main;
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "testing"
+import "time"
+
+// Writes a self signed certificate for the given name to the files
+func write_test_certificate(t *testing.T, name, cert_file, key_file string){
+    key, err:=ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    template:=x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject: pkix.Name{CommonName: name},
+        NotBefore: time.Now(),
+        NotAfter: time.Now().Add(time.Hour),
+    }
+    der, err:=x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    key_der, err:=x509.MarshalECPrivateKey(key)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    ioutil.WriteFile(cert_file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    ioutil.WriteFile(key_file, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key_der}), 0600)
+}
+
+func TestCertificate_loader(t *testing.T){
+    if _,err:=new_certificate_loader("DELETEME.crt", "DELETEME.key"); err==nil{
+        t.Error()
+    }
+
+    write_test_certificate(t, "first", "DELETEME.crt", "DELETEME.key")
+    loader, err:=new_certificate_loader("DELETEME.crt", "DELETEME.key")
+    if err!=nil{
+        t.Fatal(err)
+    }
+    common_name:=func() string{
+        certificate, _:=loader.get_certificate(&tls.ClientHelloInfo{})
+        parsed, _:=x509.ParseCertificate(certificate.Certificate[0])
+        return parsed.Subject.CommonName
+    }
+    if loader.changed() || common_name()!="first"{
+        t.Error()
+    }
+
+    stop:=make(chan struct{})
+    go loader.watch(10*time.Millisecond, stop)
+
+    // A broken certificate leaves the old one in use
+    ioutil.WriteFile("DELETEME.crt", []byte("broken"), 0600)
+    os.Chtimes("DELETEME.crt", time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+    time.Sleep(50*time.Millisecond)
+    if common_name()!="first"{
+        t.Error()
+    }
+
+    write_test_certificate(t, "second", "DELETEME.crt", "DELETEME.key")
+    os.Chtimes("DELETEME.crt", time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+    for i:=0; i<100 && common_name()!="second"; i++{
+        time.Sleep(10*time.Millisecond)
+    }
+    if common_name()!="second"{
+        t.Error()
+    }
+    close(stop)
+
+    for _,filename:=range []string{"DELETEME.crt", "DELETEME.key"}{
+        err=os.Remove(filename)
+        if err!=nil{
+            panic("Could not remove temporary file")
+        }
+    }
+}
+
+func TestHsts(t *testing.T){
+    handler:=hsts(100, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){}))
+
+    w:=httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+    if w.Header().Get("Strict-Transport-Security")!=""{
+        t.Error()
+    }
+
+    w=httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+    if w.Header().Get("Strict-Transport-Security")!="max-age=100"{
+        t.Error()
+    }
+}
+
+func TestHttps_redirect(t *testing.T){
+    redirect:=func(https_address, method, target string) (int, string){
+        w:=httptest.NewRecorder()
+        https_redirect(https_address).ServeHTTP(w, httptest.NewRequest(method, target, nil))
+        return w.Code, w.Header().Get("Location")
+    }
+
+    code, location:=redirect(":443", "GET", "http://example.com/see_all?year=2018")
+    if code!=http.StatusMovedPermanently || location!="https://example.com/see_all?year=2018"{
+        t.Error(code, location)
+    }
+    code, location=redirect(":8443", "POST", "http://example.com:8000/add_entry")
+    if code!=http.StatusPermanentRedirect || location!="https://example.com:8443/add_entry"{
+        t.Error(code, location)
+    }
+}
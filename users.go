@@ -3,7 +3,7 @@ package main;
 import "encoding/json"
 import "fmt"
 import "os"
-import "sync"
+import "path/filepath"
 import "sort"
 import "io/ioutil"
 import "errors"
@@ -27,18 +27,78 @@ func (r *Entry) Equals(other Entry) bool{
     return r.Year==other.Year && r.Month==other.Month && r.Day==other.Day && r.Slot==other.Slot
 }
 
+// Whether the entry's slot comes earlier in time than the other's
+func (r *Entry) Before(other Entry) bool{
+    if r.Year!=other.Year{
+        return r.Year<other.Year
+    }
+    if r.Month!=other.Month{
+        return r.Month<other.Month
+    }
+    if r.Day!=other.Day{
+        return r.Day<other.Day
+    }
+    return r.Slot<other.Slot
+}
+
 // Represents a user and all his entries (entries)
 type User struct{
     Name string
     Password string
     Entries []Entry
+    // Disabled users keep their entries but cannot log in
+    Disabled bool `json:",omitempty"`
+    // Salted hashes, most recent first, as many as the password policy needs to refuse
+    // reusing them
+    Previous_passwords []string `json:",omitempty"`
+}
+
+// An entry together with the name of the user it belongs to
+type Booking struct{
+    Name string
+    Entry Entry
+}
+
+// Describes an entry that was added to or removed from a user
+type Change struct{
+    Added bool
+    Name string
+    Entry Entry
 }
 
 // Represents all users
 type Users struct{
     users []User
     entry_to_user map[Entry]string
-    lock *sync.RWMutex
+    // Reports its wait times to the metrics, if there are any
+    lock *Timed_rwmutex
+    // Called (with the lock held) after every change to the entries
+    listeners []func([]Change)
+    // Increased by every change, day_revisions holds the revision of each day's last change
+    revision uint64
+    day_revisions map[Entry]uint64
+    // Closed (and replaced) whenever the revision increases
+    revision_changed chan struct{}
+    // Closed when the server shuts down, so nobody waits for changes any more
+    stopping chan struct{}
+    // When to_file last succeeded and the error of its last attempt
+    last_saved time.Time
+    save_error error
+    // Revisions start over with every process, the epoch tells them apart
+    epoch int64
+    config Config
+    // May be nil, then nothing is logged
+    audit_log *Audit_log
+    // Where old entries go
+    archive *Archive
+    // Slows down password guessing
+    login_guard *Login_guard
+    // May be nil, then every non empty password is accepted
+    password_policy *Password_policy
+    // May be nil, then there are no limits
+    rate_limiter *Rate_limiter
+    // May be nil, then nothing is counted
+    metrics *Metrics
 }
 
 func (u Users) Len() int{
@@ -65,12 +125,24 @@ func from_file(filename string) (Users,error){
     var users []User
     content, err:=ioutil.ReadFile(filename)
     if err!=nil{
-        return Users{nil,nil,nil}, err
+        return Users{}, err
     }
 
     err=json.Unmarshal(content, &users)
     if err!=nil{
-        return Users{nil,nil,nil}, err
+        return Users{}, err
+    }
+
+    // Previous passwords used to be stored as they are
+    for i:=range users{
+        for j,previous:=range users[i].Previous_passwords{
+            if !is_previous_password_hash(previous){
+                users[i].Previous_passwords[j], err=hash_previous_password(previous)
+                if err!=nil{
+                    return Users{}, err
+                }
+            }
+        }
     }
 
     entry_to_user:=make(map[Entry]string)
@@ -80,37 +152,207 @@ func from_file(filename string) (Users,error){
         }
     }
 
-    return Users{users, entry_to_user, &sync.RWMutex{}}, nil
+    return make_users(users, entry_to_user), nil
 }
 
 func new_users() Users{
-    return Users{[]User{}, make(map[Entry]string), &sync.RWMutex{}}
+    return make_users([]User{}, make(map[Entry]string))
+}
+
+func make_users(users []User, entry_to_user map[Entry]string) Users{
+    return Users{
+        users: users,
+        entry_to_user: entry_to_user,
+        lock: &Timed_rwmutex{},
+        day_revisions: make(map[Entry]uint64),
+        revision_changed: make(chan struct{}),
+        stopping: make(chan struct{}),
+        epoch: time.Now().UnixNano(),
+        config: default_config(),
+        archive: new_archive(default_config().Archive_dir),
+        login_guard: new_login_guard(default_config()),
+    }
+}
+
+// Loads the users from the configured data file
+func load_users(config Config) (Users, error){
+    users, err:=from_file(config.Data_file)
+    if err!=nil{
+        return Users{}, err
+    }
+
+    users.configure(config)
+    return users, nil
+}
+
+// Must be called before the users are shared
+func (u *Users) configure(config Config){
+    u.config=config
+    u.audit_log=nil
+    if config.Audit_file!=""{
+        u.audit_log=new_audit_log(config.Audit_file)
+    }
+    u.archive=new_archive(config.Archive_dir)
+    u.login_guard=new_login_guard(config)
+    u.password_policy=new_password_policy(config)
+    u.rate_limiter=new_rate_limiter(config)
+}
+
+// Registers a function to be called after every change to the entries. It is called
+// while the lock is held, so it must neither block nor use the Users' methods.
+func (u *Users) add_listener(listener func([]Change)){
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    u.listeners=append(u.listeners, listener)
+}
+
+// Must be called with the lock held after every mutation
+func (u *Users) notify(changes []Change){
+    u.revision++
+    close(u.revision_changed)
+    u.revision_changed=make(chan struct{})
+    if len(changes)==0{
+        return
+    }
+
+    for _,change:=range changes{
+        day:=change.Entry
+        day.Slot=0
+        u.day_revisions[day]=u.revision
+    }
+
+    for _,listener:=range u.listeners{
+        listener(changes)
+    }
+}
+
+// Makes every wait_for_day_revision return right away, now and later
+func (u *Users) stop_waiting(){
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    select{
+    case <-u.stopping:
+    default:
+        close(u.stopping)
+    }
+}
+
+func (u *Users) get_revision() uint64{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    return u.revision
+}
+
+// Returns the entries of a day together with the day's revision (0 if it never changed)
+func (u *Users) get_entries_on_day_with_revision(entry_day Entry) ([24]string, uint64){
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    ret:=[24]string{}
+    for i:=0; i<24; i++{
+        entry_day.Slot=i
+        ret[i]=u.entry_to_user[entry_day]
+    }
+
+    entry_day.Slot=0
+    return ret, u.day_revisions[entry_day]
+}
+
+// Blocks until the day's revision is greater than the given one or the timeout expires.
+// Returns the day's revision at that point.
+func (u *Users) wait_for_day_revision(entry_day Entry, revision uint64, timeout time.Duration) uint64{
+    entry_day.Slot=0
+    timer:=time.NewTimer(timeout)
+    defer timer.Stop()
+
+    for{
+        u.lock.RLock()
+        day_revision:=u.day_revisions[entry_day]
+        revision_changed:=u.revision_changed
+        u.lock.RUnlock()
+
+        if day_revision>revision{
+            return day_revision
+        }
+
+        select{
+        case <-revision_changed:
+        case <-timer.C:
+            return day_revision
+        case <-u.stopping:
+            return day_revision
+        }
+    }
 }
 
 func (u *Users) to_file(filename string) error{
     u.lock.Lock() // Full lock due to file access
     defer u.lock.Unlock()
 
+    start:=time.Now()
+    size, err:=u.write_file(filename)
+    u.metrics.observe_save(time.Since(start), size, err)
+    if err==nil{
+        u.last_saved=time.Now()
+    }
+    u.save_error=err
+    return err
+}
+
+// Must be called with the lock held, returns the size of the file
+func (u *Users) write_file(filename string) (int, error){
     // b, err := json.Marshal(u.users)
     b, err := json.MarshalIndent(u.users, "", "    ")
     if err!=nil{
-        return err
+        return 0, err
     }
 
-    f, err:=os.Create(filename)
+    // Written next to the file and renamed, so the file always holds either the old or
+    // the new data, even if the process is killed while writing
+    f, err:=ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
     if err!=nil{
-        return err
+        return 0, err
     }
-    f.Write(b)
-    f.Close()
-    return nil
+    _, err=f.Write(b)
+    if err==nil{
+        err=f.Sync()
+    }
+    close_err:=f.Close()
+    if err==nil{
+        err=close_err
+    }
+    if err==nil{
+        err=os.Rename(f.Name(), filename)
+    }
+    if err!=nil{
+        os.Remove(f.Name())
+    }
+    return len(b), err
+}
+
+// When the data was last saved and whether the last attempt failed
+func (u *Users) save_status() (time.Time, error){
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    return u.last_saved, u.save_error
 }
 
 func (u *Users) as_json() ([]byte, error){
     u.lock.RLock()
     defer u.lock.RUnlock()
 
-    b, err := json.MarshalIndent(u.users, "", "    ")
+    // Hashes of previous passwords are of no use elsewhere
+    users:=make([]User, len(u.users))
+    for i,user:=range u.users{
+        user.Previous_passwords=nil
+        users[i]=user
+    }
+
+    b, err := json.MarshalIndent(users, "", "    ")
     if err!=nil{
         return []byte{}, err
     }
@@ -118,30 +360,68 @@ func (u *Users) as_json() ([]byte, error){
     return b, nil
 }
 
-func (u *Users) remove_old_entries(){
+// Removes the entries of past days, returns what was removed
+func (u *Users) remove_old_entries(actor Actor) []Booking{
     year, month, day:=time.Now().Date()
+    return u.remove_entries_before(actor, Entry{year, int(month), day, 0})
+}
+
+// Removes the entries of days before the given one (its slot is ignored), returns what was removed
+func (u *Users) remove_entries_before(actor Actor, first_day_kept Entry) []Booking{
+    removed, _:=u.remove_entries_before_if(actor, "remove_old_entries", first_day_kept, nil)
+    return removed
+}
+
+// Removes the entries of days before first_day_kept if keep (which may be nil) accepts
+// them. Keep is called with the lock held, so nobody can book them again in between. The
+// removal is audited as action.
+func (u *Users) remove_entries_before_if(actor Actor, action string, first_day_kept Entry, keep func([]Booking) error) (removed []Booking, err error){
+    first_day_kept.Slot=0
+    defer func(){
+        if len(removed)>0{
+            u.audit_change(&err, actor, action, "", fmt.Sprintf("%d entries", len(removed)), "")
+        }
+    }()
     u.lock.Lock()
     defer u.lock.Unlock()
 
+    removed=[]Booking{}
+    for _,user:=range u.users{
+        for _,entry:=range user.Entries{
+            if entry.Before(first_day_kept){
+                removed=append(removed, Booking{user.Name, entry})
+            }
+        }
+    }
+    if keep!=nil{
+        err=keep(removed)
+        if err!=nil{
+            return nil, err
+        }
+    }
+
+    changes:=[]Change{}
     for i:=0; i<len(u.users); i++{
         entries:=[]Entry{}
         for _,entry:=range u.users[i].Entries{
-            if (entry.Year>year) ||
-               (entry.Year==year && entry.Month>int(month)) ||
-               (entry.Year==year && entry.Month==int(month) && entry.Day>=day) {
+            if !entry.Before(first_day_kept){
                 entries=append(entries, entry)
             } else{
                 delete(u.entry_to_user, entry)
+                changes=append(changes, Change{false, u.users[i].Name, entry})
             }
         }
         u.users[i].Entries=entries
     }
+    u.notify(changes)
+    return removed, nil
 }
 
-func (u *Users) add_user(name, password string) error{
+func (u *Users) add_user(actor Actor, name, password string) (err error){
     if name=="" || password==""{
         return errors.New("Neither name nor password can be empty strings")
     }
+    defer u.audit_change(&err, actor, "create_user", name, "", "")
     u.lock.Lock()
     defer u.lock.Unlock()
 
@@ -150,17 +430,24 @@ func (u *Users) add_user(name, password string) error{
             return errors.New("A user with that name already exists")
         }
     }
+    err=u.password_policy.validate(password, nil)
+    if err!=nil{
+        return err
+    }
 
-    u.users=append(u.users, User{name, password, []Entry{}})
+    u.users=append(u.users, User{name, password, []Entry{}, false, nil})
 
+    u.notify(nil)
     return nil
 }
 
-func (u *Users) remove_user(name string) error{
+func (u *Users) remove_user(actor Actor, name string) (err error){
+    defer u.audit_change(&err, actor, "delete_user", name, "", "")
     u.lock.Lock()
     defer u.lock.Unlock()
 
     users:=[]User{}
+    changes:=[]Change{}
     removed:=false
     for _,user:=range u.users{
         if user.Name!=name{
@@ -168,6 +455,7 @@ func (u *Users) remove_user(name string) error{
         } else{
             for _,entry:=range user.Entries{
                 delete(u.entry_to_user, entry)
+                changes=append(changes, Change{false, name, entry})
             }
             removed=true
         }
@@ -178,40 +466,64 @@ func (u *Users) remove_user(name string) error{
     }
 
     u.users=users
+    u.notify(changes)
     return nil
 }
 
-func (u *Users) add_entry(name string, entry Entry) error{
-    if entry.Year<2017 || entry.Month>12 || entry.Month<1 || entry.Day>31 || entry.Day<1 || entry.Slot>23 || entry.Slot<0{
-        return errors.New("Will not add invalid entry")
-    }
+func (u *Users) add_entry(actor Actor, name string, entry Entry) (err error){
+    defer u.audit_change(&err, actor, "add_entry", name, "", entry.String())
     u.lock.Lock()
     defer u.lock.Unlock()
+
+    err=u.add_entry_locked(name, entry)
+    if err!=nil{
+        return err
+    }
+
+    u.notify([]Change{Change{true, name, entry}})
+    return nil
+}
+
+func entry_is_valid(entry Entry, min_year int) bool{
+    return !(entry.Year<min_year || entry.Month>12 || entry.Month<1 || entry.Day>31 || entry.Day<1 || entry.Slot>23 || entry.Slot<0)
+}
+
+// Must be called with the lock held, does not notify
+func (u *Users) add_entry_locked(name string, entry Entry) error{
+    if !entry_is_valid(entry, u.config.Min_year){
+        return errors.New("Will not add invalid entry")
+    }
     if _,ok:=u.entry_to_user[entry]; ok{
         return errors.New("Entry already exists")
     }
 
-    added:=false
     for i:=0; i<len(u.users); i++{
         if u.users[i].Name==name{
             u.users[i].Entries=append(u.users[i].Entries, entry)
             u.entry_to_user[entry]=name
-            added=true
-            break
+            return nil
         }
     }
 
-    if !added{
-        return errors.New("User does not exist")
-    }
-
-    return nil
+    return errors.New("User does not exist")
 }
 
-func (u *Users) remove_entry(name string, entry Entry) error{
+func (u *Users) remove_entry(actor Actor, name string, entry Entry) (err error){
+    defer u.audit_change(&err, actor, "remove_entry", name, entry.String(), "")
     u.lock.Lock()
     defer u.lock.Unlock()
 
+    err=u.remove_entry_locked(name, entry)
+    if err!=nil{
+        return err
+    }
+
+    u.notify([]Change{Change{false, name, entry}})
+    return nil
+}
+
+// Must be called with the lock held, does not notify
+func (u *Users) remove_entry_locked(name string, entry Entry) error{
     removed:=false
     for i:=0; i<len(u.users); i++{
         if u.users[i].Name==name{
@@ -236,60 +548,368 @@ func (u *Users) remove_entry(name string, entry Entry) error{
     return nil
 }
 
-func (u *Users) remove_all_entries(){
+// Adds and removes several entries at once (under a single lock). Returns one error (or
+// nil) per change. If all_or_nothing is set and any change fails, the ones already made
+// are undone and every change gets an error.
+func (u *Users) apply_changes(actor Actor, changes []Change, all_or_nothing bool) (errs []error){
+    defer func(){
+        for i,change:=range changes{
+            if change.Added{
+                u.audit_change(&errs[i], actor, "add_entry", change.Name, "", change.Entry.String())
+            } else{
+                u.audit_change(&errs[i], actor, "remove_entry", change.Name, change.Entry.String(), "")
+            }
+        }
+    }()
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    // The entries as they were, to be put back directly if a change fails. Adding removed
+    // entries again could fail (like for entries from before Min_year).
+    previous_entries:=make(map[int][]Entry)
+    if all_or_nothing{
+        for _,change:=range changes{
+            for i:=0; i<len(u.users); i++{
+                if _,ok:=previous_entries[i]; !ok && u.users[i].Name==change.Name{
+                    previous_entries[i]=append([]Entry{}, u.users[i].Entries...)
+                }
+            }
+        }
+    }
+
+    errs=make([]error, len(changes))
+    applied:=[]Change{}
+    failed:=false
+    for i,change:=range changes{
+        if change.Added{
+            errs[i]=u.add_entry_locked(change.Name, change.Entry)
+        } else{
+            errs[i]=u.remove_entry_locked(change.Name, change.Entry)
+        }
+
+        if errs[i]!=nil{
+            failed=true
+            if all_or_nothing{
+                break
+            }
+        } else{
+            applied=append(applied, change)
+        }
+    }
+
+    if failed && all_or_nothing{
+        for i,entries:=range previous_entries{
+            u.users[i].Entries=entries
+        }
+        for i:=len(applied)-1; i>=0; i--{
+            if applied[i].Added{
+                delete(u.entry_to_user, applied[i].Entry)
+            } else{
+                u.entry_to_user[applied[i].Entry]=applied[i].Name
+            }
+        }
+
+        for i:=0; i<len(errs); i++{
+            if errs[i]==nil{
+                errs[i]=errors.New("Not applied because another change failed")
+            }
+        }
+        return errs
+    }
+
+    if len(applied)>0{
+        u.notify(applied)
+    }
+    return errs
+}
+
+func (u *Users) remove_all_entries(actor Actor){
+    changes:=[]Change{}
+    defer func(){
+        u.audit(actor.Request, actor.Name, "remove_all_entries", "", fmt.Sprintf("%d entries", len(changes)), "")
+    }()
     u.lock.Lock()
     defer u.lock.Unlock()
 
     for i:=0; i<len(u.users); i++{
+        for _,entry:=range u.users[i].Entries{
+            changes=append(changes, Change{false, u.users[i].Name, entry})
+        }
         u.users[i].Entries=[]Entry{}
     }
 
     u.entry_to_user=make(map[Entry]string)
+    u.notify(changes)
 }
 
 func (u *Users) get_entries_on_day(entry_day Entry) [24]string{
+    entries, _:=u.get_entries_on_day_with_revision(entry_day)
+    return entries
+}
+
+func (u *Users) get_users_password(user string) (string, error){
     u.lock.RLock()
     defer u.lock.RUnlock()
 
-    ret:=[24]string{}
-    for i:=0; i<24; i++{
-        entry_day.Slot=i
-        ret[i]=u.entry_to_user[entry_day]
+    for _,_user:=range u.users{
+        if _user.Name==user{
+            if _user.Disabled{
+                return "", errors.New("User is disabled")
+            }
+            return _user.Password, nil
+        }
     }
 
-    return ret
+    return "", errors.New("User with that name does not exist")
 }
 
-func (u *Users) get_users_password(user string) (string, error){
+func (u *Users) get_users_entries(user string) ([]Entry, error){
     u.lock.RLock()
     defer u.lock.RUnlock()
 
     for _,_user:=range u.users{
         if _user.Name==user{
-            return _user.Password, nil
+            entries:=make([]Entry, len(_user.Entries))
+            copy(entries, _user.Entries)
+            return entries, nil
         }
     }
 
-    return "", errors.New("User with that name does not exist")
+    return nil, errors.New("User with that name does not exist")
+}
+
+// A copy of the user, to work with without holding the lock
+func (u *Users) get_user_copy(name string) (User, error){
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    for _,user:=range u.users{
+        if user.Name==name{
+            return user, nil
+        }
+    }
+    return User{}, errors.New("User does not exist")
+}
+
+func (u *Users) change_password(actor Actor, user, password, new_password string) (err error){
+    if new_password==""{
+        return errors.New("New password cannot be an empty string")
+    }
+    defer u.audit_change(&err, actor, "change_password", user, "", "")
+
+    current, err:=u.get_user_copy(user)
+    if err!=nil{
+        return err
+    }
+    if current.Disabled{
+        return errors.New("User is disabled")
+    }
+    if current.Password!=password{
+        return errors.New("Incorrect password")
+    }
+    // Hashing is slow, the others should not wait for it
+    change, err:=u.password_policy.prepare(new_password, &current)
+    if err!=nil{
+        return err
+    }
+
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    for i:=0; i<len(u.users); i++{
+        if u.users[i].Name==user{
+            if u.users[i].Disabled{
+                return errors.New("User is disabled")
+            }
+            err=u.password_policy.set_password(&u.users[i], change)
+            if err!=nil{
+                return err
+            }
+            u.notify(nil)
+            return nil
+        }
+    }
+
+    return errors.New("User does not exist")
 }
 
-func (u *Users) change_password(user, password, new_password string) error{
+// Sets a user's password without knowing the old one (for admins)
+func (u *Users) reset_password(actor Actor, user, new_password string) (err error){
     if new_password==""{
         return errors.New("New password cannot be an empty string")
     }
+    defer u.audit_change(&err, actor, "reset_password", user, "", "")
+
+    current, err:=u.get_user_copy(user)
+    if err!=nil{
+        return err
+    }
+    // Hashing is slow, the others should not wait for it
+    change, err:=u.password_policy.prepare(new_password, &current)
+    if err!=nil{
+        return err
+    }
+
     u.lock.Lock()
     defer u.lock.Unlock()
 
     for i:=0; i<len(u.users); i++{
         if u.users[i].Name==user{
-            if u.users[i].Password!=password{
-                return errors.New("Incorrect password")
+            err=u.password_policy.set_password(&u.users[i], change)
+            if err!=nil{
+                return err
             }
+            u.notify(nil)
+            return nil
+        }
+    }
+
+    return errors.New("User does not exist")
+}
+
+// Renames a user, its entries are kept
+func (u *Users) rename_user(actor Actor, name, new_name string) (err error){
+    if new_name==""{
+        return errors.New("New name cannot be an empty string")
+    }
+    defer u.audit_change(&err, actor, "rename_user", name, name, new_name)
+    u.lock.Lock()
+    defer u.lock.Unlock()
+
+    index:=-1
+    for i:=0; i<len(u.users); i++{
+        if u.users[i].Name==new_name{
+            return errors.New("A user with that name already exists")
+        }
+        if u.users[i].Name==name{
+            index=i
+        }
+    }
+
+    if index<0{
+        return errors.New("User does not exist")
+    }
+
+    // To anyone watching, the entries move from one user to the other
+    changes:=[]Change{}
+    u.users[index].Name=new_name
+    for _,entry:=range u.users[index].Entries{
+        u.entry_to_user[entry]=new_name
+        changes=append(changes, Change{false, name, entry}, Change{true, new_name, entry})
+    }
+
+    u.notify(changes)
+    return nil
+}
+
+func (u *Users) set_user_disabled(actor Actor, name string, disabled bool) (err error){
+    if disabled{
+        defer u.audit_change(&err, actor, "disable_user", name, "enabled", "disabled")
+    } else{
+        defer u.audit_change(&err, actor, "enable_user", name, "disabled", "enabled")
+    }
+    u.lock.Lock()
+    defer u.lock.Unlock()
 
-            u.users[i].Password=new_password
+    for i:=0; i<len(u.users); i++{
+        if u.users[i].Name==name{
+            u.users[i].Disabled=disabled
+            u.notify(nil)
             return nil
         }
     }
 
     return errors.New("User does not exist")
-}
\ No newline at end of file
+}
+
+// Returns every user's name and whether it is disabled, but not their passwords
+func (u *Users) get_user_list() []User{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    ret:=make([]User, len(u.users))
+    for i,user:=range u.users{
+        ret[i]=User{user.Name, "", nil, user.Disabled, nil}
+    }
+
+    return ret
+}
+
+// Returns every entry and its user, in chronological order
+// How many entries are booked, without copying them
+func (u *Users) count_bookings() int{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    count:=0
+    for _,user:=range u.users{
+        count+=len(user.Entries)
+    }
+    return count
+}
+
+// How many users there are (including disabled ones), without copying them
+func (u *Users) count_users() int{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    return len(u.users)
+}
+
+func (u *Users) get_bookings() []Booking{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    bookings:=[]Booking{}
+    for _,user:=range u.users{
+        for _,entry:=range user.Entries{
+            bookings=append(bookings, Booking{user.Name, entry})
+        }
+    }
+
+    sort.Slice(bookings, func(i, j int) bool{
+        return bookings[i].Entry.Before(bookings[j].Entry)
+    })
+    return bookings
+}
+
+// The problem check reports when the admin is missing, which serve can fix by creating it
+const problem_no_admin="There is no admin user"
+
+// Looks for inconsistencies in the data, returns a description of each one found
+func (u *Users) check() []string{
+    u.lock.RLock()
+    defer u.lock.RUnlock()
+
+    problems:=[]string{}
+    names:=make(map[string]bool)
+    owners:=make(map[Entry]string)
+    for _,user:=range u.users{
+        if user.Name==""{
+            problems=append(problems, "A user has an empty name")
+        }
+        if names[user.Name]{
+            problems=append(problems, fmt.Sprintf("User %q exists more than once", user.Name))
+        }
+        names[user.Name]=true
+        if user.Password==""{
+            problems=append(problems, fmt.Sprintf("User %q has an empty password", user.Name))
+        }
+
+        for _,entry:=range user.Entries{
+            if !entry_is_valid(entry, u.config.Min_year){
+                problems=append(problems, fmt.Sprintf("User %q has an invalid entry: %s", user.Name, entry.String()))
+            }
+            if owner,ok:=owners[entry]; ok{
+                problems=append(problems, fmt.Sprintf("Entry %s belongs to both %q and %q", entry.String(), owner, user.Name))
+            }
+            owners[entry]=user.Name
+        }
+    }
+
+    if !names["admin"]{
+        problems=append(problems, problem_no_admin)
+    }
+
+    return problems
+}
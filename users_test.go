@@ -39,7 +39,7 @@ func TestUsersLen(t *testing.T){
         t.Error()
     }
 
-    users.users=append(users.users, User{"", "", []Entry{}})
+    users.users=append(users.users, User{"", "", []Entry{}, false, nil})
     if users.Len()!=1{
         t.Error()
     }
@@ -47,8 +47,8 @@ func TestUsersLen(t *testing.T){
 
 func TestUsersLess(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"a", "", []Entry{}})
-    users.users=append(users.users, User{"b", "", []Entry{}})
+    users.users=append(users.users, User{"a", "", []Entry{}, false, nil})
+    users.users=append(users.users, User{"b", "", []Entry{}, false, nil})
     if users.Less(0,1)!=true{
         t.Error()
     }
@@ -60,8 +60,8 @@ func TestUsersLess(t *testing.T){
 
 func TestUsersSwap(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"a", "", []Entry{}})
-    users.users=append(users.users, User{"b", "", []Entry{}})
+    users.users=append(users.users, User{"a", "", []Entry{}, false, nil})
+    users.users=append(users.users, User{"b", "", []Entry{}, false, nil})
     users.Swap(0,1)
 
     if users.users[0].Name!="b" || users.users[1].Name!="a"{
@@ -71,8 +71,8 @@ func TestUsersSwap(t *testing.T){
 
 func TestUsersSort(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"b", "", []Entry{}})
-    users.users=append(users.users, User{"a", "", []Entry{}})
+    users.users=append(users.users, User{"b", "", []Entry{}, false, nil})
+    users.users=append(users.users, User{"a", "", []Entry{}, false, nil})
     users.Sort()
 
     if users.users[0].Name!="a" || users.users[1].Name!="b"{
@@ -160,8 +160,8 @@ func TestUsersFrom_file(t *testing.T){
 
 func TestUsersTo_file(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"a", "ap", []Entry{}})
-    users.users=append(users.users, User{"b", "bp", []Entry{Entry{1,2,3,4}, Entry{5,6,7,8}}})
+    users.users=append(users.users, User{"a", "ap", []Entry{}, false, nil})
+    users.users=append(users.users, User{"b", "bp", []Entry{Entry{1,2,3,4}, Entry{5,6,7,8}}, false, nil})
 
     users.to_file("DELETEME.json")
     users, err:=from_file("DELETEME.json")
@@ -203,10 +203,40 @@ func TestUsersTo_file(t *testing.T){
     }
 }
 
+func TestUsersTo_fileAtomic(t *testing.T){
+    err:=os.Mkdir("DELETEME", 0700)
+    if err!=nil{
+        t.Fatal(err)
+    }
+    users:=new_users()
+    users.add_user(Actor{}, "a", "ap")
+
+    // Replaces the old file and leaves nothing else behind
+    ioutil.WriteFile("DELETEME/users.json", []byte("old"), 0600)
+    err=users.to_file("DELETEME/users.json")
+    files, _:=ioutil.ReadDir("DELETEME")
+    if err!=nil || len(files)!=1{
+        t.Error(err)
+    }
+    if _,err:=from_file("DELETEME/users.json"); err!=nil{
+        t.Error(err)
+    }
+
+    // Errors are reported
+    if users.to_file("DELETEME/missing/users.json")==nil{
+        t.Error()
+    }
+
+    err=os.RemoveAll("DELETEME")
+    if err!=nil{
+        panic("Could not remove temporary directory")
+    }
+}
+
 func TestUsersAs_json(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"a", "ap", []Entry{}})
-    users.users=append(users.users, User{"b", "bp", []Entry{Entry{1,2,3,4}, Entry{5,6,7,8}}})
+    users.users=append(users.users, User{"a", "ap", []Entry{}, false, nil})
+    users.users=append(users.users, User{"b", "bp", []Entry{Entry{1,2,3,4}, Entry{5,6,7,8}}, false, nil})
 
     json,err:=users.as_json()
     if err!=nil{
@@ -260,7 +290,7 @@ func TestUsersAs_json(t *testing.T){
 
 func TestUsersRemove_old_entries(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"b", "bp", []Entry{}})
+    users.users=append(users.users, User{"b", "bp", []Entry{}, false, nil})
 
     year, month, day:=time.Now().Date()
     users.users[0].Entries=append(users.users[0].Entries, Entry{int(year), int(month), int(day)+1, 2})
@@ -269,7 +299,7 @@ func TestUsersRemove_old_entries(t *testing.T){
     users.users[0].Entries=append(users.users[0].Entries, Entry{int(year), int(month)-1, int(day), 2})
     users.users[0].Entries=append(users.users[0].Entries, Entry{int(year)+1, int(month), int(day), 2})
     users.users[0].Entries=append(users.users[0].Entries, Entry{int(year)-1, int(month), int(day), 2})
-    users.remove_old_entries()
+    users.remove_old_entries(Actor{})
 
     if len(users.users[0].Entries)!=3{
         t.Error()
@@ -278,8 +308,8 @@ func TestUsersRemove_old_entries(t *testing.T){
 
 func TestUsersAdd_user(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"b", "bp", []Entry{}})
-    err:=users.add_user("name", "password")
+    users.users=append(users.users, User{"b", "bp", []Entry{}, false, nil})
+    err:=users.add_user(Actor{}, "name", "password")
     if err!=nil{
         t.Error()
         return
@@ -293,7 +323,7 @@ func TestUsersAdd_user(t *testing.T){
         t.Error()
     }
 
-    err=users.add_user("name", "password")
+    err=users.add_user(Actor{}, "name", "password")
     if err==nil{
         t.Error()
     }
@@ -302,12 +332,12 @@ func TestUsersAdd_user(t *testing.T){
         t.Error()
     }
 
-    err=users.add_user("", "password")
+    err=users.add_user(Actor{}, "", "password")
     if err==nil{
         t.Error()
     }
 
-    err=users.add_user("othername", "")
+    err=users.add_user(Actor{}, "othername", "")
     if err==nil{
         t.Error()
     }
@@ -319,10 +349,10 @@ func TestUsersAdd_user(t *testing.T){
 
 func TestUsersRemove_user(t *testing.T){
     users:=new_users()
-    users.users=append(users.users, User{"b", "bp", []Entry{}})
-    users.add_user("name", "password")
+    users.users=append(users.users, User{"b", "bp", []Entry{}, false, nil})
+    users.add_user(Actor{}, "name", "password")
 
-    err:=users.remove_user("name")
+    err:=users.remove_user(Actor{}, "name")
     if err!=nil{
         t.Error(err)
         return
@@ -332,7 +362,7 @@ func TestUsersRemove_user(t *testing.T){
         t.Error(err)
     }
 
-    err=users.remove_user("name")
+    err=users.remove_user(Actor{}, "name")
     if err==nil{
         t.Error()
         return
@@ -342,17 +372,17 @@ func TestUsersRemove_user(t *testing.T){
 
 func TestUsersAdd_entry(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
+    users.add_user(Actor{}, "name", "password")
 
     if len(users.users[0].Entries)!=0 || len(users.entry_to_user)!=0{
         t.Error()
     }
 
-    if users.add_entry("gnome", Entry{2018, 7, 28, 2})==nil{
+    if users.add_entry(Actor{}, "gnome", Entry{2018, 7, 28, 2})==nil{
         t.Error()
     }
 
-    if users.add_entry("name", Entry{2018, 7, 28, 2})!=nil{
+    if users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 2})!=nil{
         t.Error()
     }
 
@@ -360,39 +390,39 @@ func TestUsersAdd_entry(t *testing.T){
         t.Error()
     }
 
-    if users.add_entry("name", Entry{2018, 7, 28, 2})==nil{
+    if users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 2})==nil{
         t.Error()
     }
 
     // Test invalid entries
-    if users.add_entry("name", Entry{2018, 7, 28, -1})==nil ||
-    users.add_entry("name", Entry{2018, 7, 28, 24})==nil ||
-    users.add_entry("name", Entry{2018, 7, 32, 2})==nil ||
-    users.add_entry("name", Entry{2018, 7, 0, 2})==nil ||
-    users.add_entry("name", Entry{2018, 0, 28, 2})==nil ||
-    users.add_entry("name", Entry{2018, 13, 28, 2})==nil ||
-    users.add_entry("name", Entry{2016, 7, 28, 2})==nil{
+    if users.add_entry(Actor{}, "name", Entry{2018, 7, 28, -1})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 24})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 32, 2})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 0, 2})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2018, 0, 28, 2})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2018, 13, 28, 2})==nil ||
+    users.add_entry(Actor{}, "name", Entry{2016, 7, 28, 2})==nil{
         t.Error()
     }
 }
 
 func TestUsersRemove_entry(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
-    users.add_entry("name", Entry{2018, 7, 28, 2})
+    users.add_user(Actor{}, "name", "password")
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 2})
 
-    if users.remove_entry("gnome", Entry{2018, 7, 28, 2})==nil{
+    if users.remove_entry(Actor{}, "gnome", Entry{2018, 7, 28, 2})==nil{
         t.Error()
     }
 
-    if users.remove_entry("name", Entry{2018, 7, 28, 3})==nil ||
-    users.remove_entry("name", Entry{2018, 7, 27, 2})==nil ||
-    users.remove_entry("name", Entry{2018, 6, 28, 2})==nil ||
-    users.remove_entry("name", Entry{2019, 7, 28, 2})==nil{
+    if users.remove_entry(Actor{}, "name", Entry{2018, 7, 28, 3})==nil ||
+    users.remove_entry(Actor{}, "name", Entry{2018, 7, 27, 2})==nil ||
+    users.remove_entry(Actor{}, "name", Entry{2018, 6, 28, 2})==nil ||
+    users.remove_entry(Actor{}, "name", Entry{2019, 7, 28, 2})==nil{
         t.Error()
     }
 
-    if users.remove_entry("name", Entry{2018, 7, 28, 2})!=nil{
+    if users.remove_entry(Actor{}, "name", Entry{2018, 7, 28, 2})!=nil{
         t.Error()
     }
 
@@ -401,27 +431,164 @@ func TestUsersRemove_entry(t *testing.T){
     }
 }
 
+func TestUsersApply_changes(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "ap")
+    users.add_user(Actor{}, "b", "bp")
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,4})
+
+    changes:=[]Change{
+        Change{true, "b", Entry{2017,2,3,5}},
+        Change{false, "a", Entry{2017,2,3,4}},
+        Change{true, "a", Entry{2017,2,3,5}},
+        Change{true, "c", Entry{2017,2,3,6}},
+    }
+
+    // Nothing changes if one of them fails
+    revision:=users.get_revision()
+    errs:=users.apply_changes(Actor{}, changes, true)
+    if len(errs)!=4 || errs[0]==nil || errs[2]==nil || errs[3]==nil{
+        t.Error()
+    }
+    if users.entry_to_user[Entry{2017,2,3,4}]!="a" || users.entry_to_user[Entry{2017,2,3,5}]!="" || users.get_revision()!=revision{
+        t.Error()
+    }
+    if len(users.users[0].Entries)!=1 || len(users.users[1].Entries)!=0{
+        t.Error()
+    }
+
+    // Best effort
+    errs=users.apply_changes(Actor{}, changes, false)
+    if errs[0]!=nil || errs[1]!=nil || errs[2]==nil || errs[3]==nil{
+        t.Error()
+    }
+    if users.entry_to_user[Entry{2017,2,3,4}]!="" || users.entry_to_user[Entry{2017,2,3,5}]!="b"{
+        t.Error()
+    }
+    if len(users.users[0].Entries)!=0 || len(users.users[1].Entries)!=1{
+        t.Error()
+    }
+
+    // Entries that could not be added anymore are put back too
+    old_entry:=Entry{users.config.Min_year-1,2,3,4}
+    users.users[0].Entries=[]Entry{old_entry}
+    users.entry_to_user[old_entry]="a"
+    errs=users.apply_changes(Actor{}, []Change{Change{false, "a", old_entry}, Change{true, "c", Entry{2017,2,3,6}}}, true)
+    if errs[0]==nil || errs[1]==nil{
+        t.Error()
+    }
+    if len(users.users[0].Entries)!=1 || users.entry_to_user[old_entry]!="a"{
+        t.Error()
+    }
+}
+
 func TestUsersRemove_all_entries(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
-    users.add_entry("name", Entry{2018, 7, 28, 2})
+    users.add_user(Actor{}, "name", "password")
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 2})
 
     if len(users.users[0].Entries)==0 || len(users.entry_to_user)==0{
         t.Error()
     }
 
-    users.remove_all_entries()
+    users.remove_all_entries(Actor{})
 
     if len(users.users[0].Entries)!=0 || len(users.entry_to_user)!=0{
         t.Error()
     }
 }
 
+func TestUsersRemove_all_entriesNotify(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+    users.add_entry(Actor{}, "name", Entry{2017,2,3,4})
+    users.add_entry(Actor{}, "name", Entry{2017,2,4,4})
+
+    changes:=[]Change{}
+    users.add_listener(func(c []Change){
+        changes=append(changes, c...)
+    })
+    users.remove_all_entries(Actor{})
+
+    if len(changes)!=2 || changes[0].Added || changes[1].Added{
+        t.Error()
+    }
+}
+
+func TestUsersRevision(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+    revision:=users.get_revision()
+    if revision==0{
+        t.Error()
+    }
+
+    users.add_entry(Actor{}, "name", Entry{2017,2,3,4})
+    entries, day_revision:=users.get_entries_on_day_with_revision(Entry{2017,2,3,0})
+    if entries[4]!="name" || day_revision<=revision || day_revision!=users.get_revision(){
+        t.Error()
+    }
+
+    // Other days are not affected
+    users.add_entry(Actor{}, "name", Entry{2017,2,4,4})
+    _, other_day_revision:=users.get_entries_on_day_with_revision(Entry{2017,2,3,0})
+    if other_day_revision!=day_revision{
+        t.Error()
+    }
+
+    // Failed changes do not count
+    revision=users.get_revision()
+    users.add_entry(Actor{}, "name", Entry{2017,2,4,4})
+    if users.get_revision()!=revision{
+        t.Error()
+    }
+}
+
+func TestUsersWait_for_day_revision(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+
+    if users.wait_for_day_revision(Entry{2017,2,3,0}, 0, time.Millisecond)!=0{
+        t.Error()
+    }
+
+    go func(){
+        time.Sleep(10*time.Millisecond)
+        users.add_entry(Actor{}, "name", Entry{2017,2,4,4})
+        users.add_entry(Actor{}, "name", Entry{2017,2,3,4})
+    }()
+
+    if users.wait_for_day_revision(Entry{2017,2,3,0}, 0, 10*time.Second)!=users.get_revision(){
+        t.Error()
+    }
+}
+
+func TestUsersStop_waiting(t *testing.T){
+    users:=new_users()
+    go func(){
+        time.Sleep(10*time.Millisecond)
+        users.stop_waiting()
+    }()
+
+    start:=time.Now()
+    users.wait_for_day_revision(Entry{2017,2,3,0}, 0, 10*time.Second)
+    if time.Since(start)>5*time.Second{
+        t.Error()
+    }
+
+    // Later waits do not wait either, stopping twice is fine
+    users.stop_waiting()
+    users.wait_for_day_revision(Entry{2017,2,3,0}, 0, 10*time.Second)
+    if time.Since(start)>5*time.Second{
+        t.Error()
+    }
+}
+
 func TestUsersGet_entries_on_day(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
-    users.add_entry("name", Entry{2018, 7, 28, 2})
-    users.add_entry("name", Entry{2018, 7, 29, 3})
+    users.add_user(Actor{}, "name", "password")
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 28, 2})
+    users.add_entry(Actor{}, "name", Entry{2018, 7, 29, 3})
 
     for i, entry_string:=range users.get_entries_on_day(Entry{2018, 7, 28, 0}){
         if (((entry_string=="name")!=(i==2)) || ((entry_string=="") != (i!=2))){
@@ -439,7 +606,7 @@ func TestUsersGet_entries_on_day(t *testing.T){
 
 func TestUsersGet_users_password(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
+    users.add_user(Actor{}, "name", "password")
 
     password, err:=users.get_users_password("gnome")
     if password!="" || err==nil{
@@ -452,19 +619,35 @@ func TestUsersGet_users_password(t *testing.T){
     }
 }
 
+func TestUsersGet_users_entries(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+    users.add_entry(Actor{}, "name", Entry{2017,2,3,4})
+
+    entries, err:=users.get_users_entries("gnome")
+    if entries!=nil || err==nil{
+        t.Error()
+    }
+
+    entries, err=users.get_users_entries("name")
+    if err!=nil || len(entries)!=1 || !entries[0].Equals(Entry{2017,2,3,4}){
+        t.Error()
+    }
+}
+
 func TestUsersChange_password(t *testing.T){
     users:=new_users()
-    users.add_user("name", "password")
+    users.add_user(Actor{}, "name", "password")
 
-    if users.change_password("gnome", "password", "otherpassword")==nil{
+    if users.change_password(Actor{}, "gnome", "password", "otherpassword")==nil{
         t.Error()
     }
 
-    if users.change_password("name", "otherpassword", "otherpassword")==nil{
+    if users.change_password(Actor{}, "name", "otherpassword", "otherpassword")==nil{
         t.Error()
     }
 
-    if users.change_password("name", "password", "")==nil{
+    if users.change_password(Actor{}, "name", "password", "")==nil{
         t.Error()
     }
 
@@ -472,11 +655,142 @@ func TestUsersChange_password(t *testing.T){
         t.Error()
     }
 
-    if users.change_password("name", "password", "otherpassword")!=nil{
+    if users.change_password(Actor{}, "name", "password", "otherpassword")!=nil{
         t.Error()
     }
 
     if users.users[0].Password!="otherpassword"{
         t.Error()
     }
-}
\ No newline at end of file
+}
+
+func TestUsersReset_password(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+
+    if users.reset_password(Actor{}, "gnome", "otherpassword")==nil || users.reset_password(Actor{}, "name", "")==nil{
+        t.Error()
+    }
+
+    if users.reset_password(Actor{}, "name", "otherpassword")!=nil || users.users[0].Password!="otherpassword"{
+        t.Error()
+    }
+}
+
+func TestUsersRename_user(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "ap")
+    users.add_user(Actor{}, "b", "bp")
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,4})
+
+    if users.rename_user(Actor{}, "a", "b")==nil || users.rename_user(Actor{}, "a", "")==nil || users.rename_user(Actor{}, "c", "d")==nil{
+        t.Error()
+    }
+
+    if users.rename_user(Actor{}, "a", "c")!=nil{
+        t.Error()
+        return
+    }
+
+    if users.users[0].Name!="c" || users.entry_to_user[Entry{2017,2,3,4}]!="c"{
+        t.Error()
+    }
+
+    if _,err:=users.get_users_password("c"); err!=nil{
+        t.Error()
+    }
+}
+
+func TestUsersSet_user_disabled(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "name", "password")
+
+    if users.set_user_disabled(Actor{}, "gnome", true)==nil{
+        t.Error()
+    }
+
+    if users.set_user_disabled(Actor{}, "name", true)!=nil{
+        t.Error()
+    }
+
+    // Disabled users cannot log in or change their password
+    if _,err:=users.get_users_password("name"); err==nil{
+        t.Error()
+    }
+
+    if users.change_password(Actor{}, "name", "password", "otherpassword")==nil{
+        t.Error()
+    }
+
+    list:=users.get_user_list()
+    if len(list)!=1 || !list[0].Disabled || list[0].Password!=""{
+        t.Error()
+    }
+
+    users.set_user_disabled(Actor{}, "name", false)
+    if password,err:=users.get_users_password("name"); err!=nil || password!="password"{
+        t.Error()
+    }
+}
+
+func TestEntryBefore(t *testing.T){
+    entry:=Entry{2017,2,3,4}
+    if entry.Before(entry) || !entry.Before(Entry{2017,2,3,5}) || !entry.Before(Entry{2017,2,4,0}) || !entry.Before(Entry{2017,3,1,0}) || !entry.Before(Entry{2018,1,1,0}){
+        t.Error()
+    }
+
+    if entry.Before(Entry{2017,2,3,3}) || entry.Before(Entry{2016,12,31,23}){
+        t.Error()
+    }
+}
+
+func TestUsersGet_bookings(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "ap")
+    users.add_user(Actor{}, "b", "bp")
+    users.add_entry(Actor{}, "a", Entry{2017,2,4,4})
+    users.add_entry(Actor{}, "b", Entry{2017,2,3,4})
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,5})
+
+    bookings:=users.get_bookings()
+    if len(bookings)!=3{
+        t.Error()
+        return
+    }
+
+    if bookings[0]!=(Booking{"b", Entry{2017,2,3,4}}) || bookings[1]!=(Booking{"a", Entry{2017,2,3,5}}) || bookings[2]!=(Booking{"a", Entry{2017,2,4,4}}){
+        t.Error()
+    }
+}
+
+func TestUsersCheck(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "admin", "password")
+    users.add_user(Actor{}, "a", "ap")
+    users.add_entry(Actor{}, "a", Entry{2017,2,3,4})
+    if len(users.check())!=0{
+        t.Error()
+    }
+
+    users.users=append(users.users, User{"a", "", []Entry{Entry{2017,2,3,4}, Entry{2017,13,3,4}}, false, nil})
+    users.users[0].Name="b"
+    if len(users.check())!=5{
+        t.Error(users.check())
+    }
+}
+
+func TestUsersRemove_entries_before(t *testing.T){
+    users:=new_users()
+    users.add_user(Actor{}, "a", "password")
+    users.add_entry(Actor{}, "a", Entry{2017,5,2,23})
+    users.add_entry(Actor{}, "a", Entry{2017,5,3,0})
+    users.add_entry(Actor{}, "a", Entry{2018,1,1,5})
+
+    removed:=users.remove_entries_before(Actor{}, Entry{2017,5,3,12})
+    if len(removed)!=1 || removed[0]!=(Booking{"a", Entry{2017,5,2,23}}){
+        t.Error(removed)
+    }
+    if len(users.users[0].Entries)!=2 || len(users.entry_to_user)!=2{
+        t.Error()
+    }
+}